@@ -0,0 +1,83 @@
+package memhttp
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// EstimatedRequestBytes estimates the size of the request with the given ID
+// (assigned by WithRequestID) and of its response. It reports false if the
+// server wasn't constructed WithRequestID or hasn't finished handling the
+// request. Only the most recent 1,000 requests are retained.
+//
+// The sizes are estimates, not counts of the bytes on the wire. They're
+// computed as if the messages were sent over HTTP/1.1 without chunking or
+// TLS, regardless of the protocol actually in use: each includes the request
+// or status line, the headers, and the body. HTTP/2 framing and header
+// compression aren't accounted for. Headers that net/http adds automatically
+// (like Date) aren't counted, and only the portion of the request body the
+// handler reads is counted. Differences between the estimates for similar
+// exchanges are accurate measures of differences in body size.
+func (s *Server) EstimatedRequestBytes(id string) (reqBytes, respBytes int64, ok bool) {
+	if s.bytes == nil {
+		return 0, 0, false
+	}
+	return s.bytes.get(id)
+}
+
+type byteCounts struct {
+	mu     sync.Mutex
+	counts recentMap[[2]int64]
+}
+
+func (b *byteCounts) get(id string) (int64, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.counts.get(id)
+	return c[0], c[1], ok
+}
+
+// wrap must be wrapped by withRequestID.
+func (b *byteCounts) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := RequestIDFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqBody := &cappedBuffer{}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeBody{ReadCloser: r.Body, w: reqBody}
+		}
+		reqHeader := r.Header.Clone()
+		rw := &harWriter{ResponseWriter: w, body: &cappedBuffer{}}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if rw.header == nil {
+			rw.header = rw.Header().Clone()
+		}
+		reqLine := fmt.Sprintf("%s %s %s\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.Proto, r.Host)
+		statusLine := fmt.Sprintf("%s %03d %s\r\n", r.Proto, rw.status, http.StatusText(rw.status))
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.counts.put(id, [2]int64{
+			int64(len(reqLine)) + headerBytes(reqHeader) + reqBody.total,
+			int64(len(statusLine)) + headerBytes(rw.header) + rw.body.total,
+		})
+	})
+}
+
+// headerBytes is the size of h in HTTP/1.1 wire format, including the blank
+// line that ends the headers.
+func headerBytes(h http.Header) int64 {
+	n := int64(len("\r\n"))
+	for name, values := range h {
+		for _, v := range values {
+			n += int64(len(name) + len(": ") + len(v) + len("\r\n"))
+		}
+	}
+	return n
+}
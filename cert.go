@@ -0,0 +1,169 @@
+package memhttp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// A KeyType is the type of key in a generated certificate. See WithKeyType.
+type KeyType int
+
+// Supported key types. The embedded certificate uses an RSA2048 key.
+const (
+	RSA2048 KeyType = iota + 1
+	ECDSAP256
+	Ed25519
+)
+
+func (k KeyType) String() string {
+	switch k {
+	case RSA2048:
+		return "RSA2048"
+	case ECDSAP256:
+		return "ECDSAP256"
+	case Ed25519:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("KeyType(%d)", int(k))
+	}
+}
+
+func (k KeyType) generate() (crypto.Signer, error) {
+	switch k {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %v", k)
+	}
+}
+
+// defaultSANs are the subject alternative names of the embedded certificate.
+var defaultSANs = []string{"example.com", "127.0.0.1", "::1"}
+
+// A CA is an in-memory certificate authority. It issues server and client
+// certificates for tests, without any external tooling. To serve a
+// certificate issued by a CA, use WithCA; to require clients to present
+// certificates issued by a CA, use WithClientCA.
+type CA struct {
+	cert tls.Certificate
+}
+
+// NewCA creates a certificate authority valid for ten years.
+func NewCA() (*CA, error) {
+	now := time.Now()
+	return newCA(now.Add(-time.Hour), now.AddDate(10, 0, 0))
+}
+
+func newCA(notBefore, notAfter time.Time) (*CA, error) {
+	cert, err := issueCertificate(&x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"memhttp"}, CommonName: "memhttp CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, ECDSAP256, nil /* self-signed */)
+	if err != nil {
+		return nil, fmt.Errorf("create CA: %v", err)
+	}
+	return &CA{cert: cert}, nil
+}
+
+// Certificate returns the CA's own certificate.
+func (ca *CA) Certificate() *x509.Certificate {
+	return ca.cert.Leaf
+}
+
+// CertPool returns a new pool containing only the CA's certificate.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert.Leaf)
+	return pool
+}
+
+// IssueServer issues a server certificate covering the given DNS names and IP
+// addresses. It's valid for as long as the CA is, and it has an ECDSAP256 key.
+func (ca *CA) IssueServer(sans ...string) (tls.Certificate, error) {
+	return ca.issueServer(sans, ca.cert.Leaf.NotBefore, ca.cert.Leaf.NotAfter, ECDSAP256)
+}
+
+// IssueClient issues a client certificate with the given common name. It's
+// valid for as long as the CA is.
+func (ca *CA) IssueClient(cn string) (tls.Certificate, error) {
+	cert, err := issueCertificate(&x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"memhttp"}, CommonName: cn},
+		NotBefore:   ca.cert.Leaf.NotBefore,
+		NotAfter:    ca.cert.Leaf.NotAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ECDSAP256, &ca.cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("issue client certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func (ca *CA) issueServer(sans []string, notBefore, notAfter time.Time, keyType KeyType) (tls.Certificate, error) {
+	leaf := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"memhttp"}},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			leaf.IPAddresses = append(leaf.IPAddresses, ip)
+		} else {
+			leaf.DNSNames = append(leaf.DNSNames, san)
+		}
+	}
+	cert, err := issueCertificate(leaf, keyType, &ca.cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("issue server certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// issueCertificate generates a key of the given type and creates a
+// certificate from template, signed by parent. If parent is nil, the
+// certificate is self-signed. The returned certificate's Leaf is populated.
+func issueCertificate(template *x509.Certificate, keyType KeyType, parent *tls.Certificate) (tls.Certificate, error) {
+	key, err := keyType.generate()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %v", err)
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial number: %v", err)
+	}
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
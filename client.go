@@ -0,0 +1,308 @@
+package memhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ClientWithInterceptor returns a client like the one returned by Client, but
+// which first passes each request to intercept. If intercept returns true, the
+// client returns the intercepted response without contacting the server; the
+// response must not be nil. Otherwise, the request flows to the server as usual.
+//
+// This is useful for stubbing a few paths in integration tests without
+// modifying the server's handler.
+func (s *Server) ClientWithInterceptor(intercept func(*http.Request) (*http.Response, bool)) *http.Client {
+	return &http.Client{Transport: &interceptor{
+		intercept: intercept,
+		next:      s.Transport(),
+	}}
+}
+
+type interceptor struct {
+	intercept func(*http.Request) (*http.Response, bool)
+	next      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (i *interceptor) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, ok := i.intercept(req)
+	if !ok {
+		return i.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if res == nil {
+		return nil, errors.New("memhttp: interceptor returned nil response")
+	}
+	if res.Request == nil {
+		res.Request = req
+	}
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+	return res, nil
+}
+
+// RetryingClient returns a client like the one returned by Client, but which
+// retries idempotent requests that fail without a response because of a
+// transient error, making up to attempts attempts in total. Transient errors
+// are dial timeouts (for example, while the server is paused), dials to closed
+// listeners, and broken connections. Other errors, including TLS certificate
+// verification failures and the end of the request's context, are returned
+// immediately. Retries are immediate. Requests with bodies are retried
+// only if their GetBody field is set, as it is for requests created by
+// [http.NewRequest] with common body types. Requests aren't retried after
+// their context ends.
+//
+// This is useful for testing the resilience of idempotent handlers.
+func (s *Server) RetryingClient(attempts int) *http.Client {
+	return &http.Client{Transport: &retrier{
+		attempts: attempts,
+		next:     s.Transport(),
+	}}
+}
+
+type retrier struct {
+	attempts int
+	next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *retrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.next.RoundTrip(req)
+	for attempt := 1; err != nil && attempt < r.attempts && retryable(req, err); attempt++ {
+		if req.Body != nil && req.Body != http.NoBody {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		res, err = r.next.RoundTrip(req)
+	}
+	return res, err
+}
+
+func retryable(req *http.Request, err error) bool {
+	if req.Context().Err() != nil || !transient(err) {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// transient reports whether err is likely to go away if the request is sent
+// again.
+func transient(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &certErr) {
+		return false
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded) || // dial timeout
+		errors.Is(err, errListenerClosed) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// Invoke sends req to the server over a new in-memory connection and returns
+// the response, without following redirects. Unlike calling a handler with an
+// httptest.ResponseRecorder, requests and responses pass through net/http's
+// real serving path, so headers are canonicalized, server-added headers like
+// Date are present, and protocol rules are enforced. The connection closes
+// once the caller closes the response body.
+//
+// If req's URL has no scheme or host, as with requests created by
+// [net/http/httptest.NewRequest], Invoke fills them in from the server's URL.
+func (s *Server) Invoke(req *http.Request) (*http.Response, error) {
+	base, err := url.Parse(s.URL())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.RequestURI = ""
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = base.Scheme
+	}
+	if req.URL.Host == "" {
+		req.URL.Host = base.Host
+	}
+	transport := s.Transport()
+	transport.DisableKeepAlives = true
+	return transport.RoundTrip(req)
+}
+
+// ClientWithHeaders returns a client like the one returned by Client, but
+// which adds the given headers to each request. Headers already set on a
+// request take precedence over the defaults.
+//
+// This is useful for attaching credentials or tracing headers to every
+// request in a test.
+func (s *Server) ClientWithHeaders(h http.Header) *http.Client {
+	defaults := make(http.Header, len(h))
+	for key, values := range h {
+		defaults[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return &http.Client{Transport: &headerInjector{
+		defaults: defaults,
+		next:     s.Transport(),
+	}}
+}
+
+type headerInjector struct {
+	defaults http.Header
+	next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (i *headerInjector) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify requests, so add headers to a copy.
+	cloned := false
+	for key, values := range i.defaults {
+		if _, ok := req.Header[key]; ok {
+			continue
+		}
+		if !cloned {
+			req = req.Clone(req.Context())
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+			cloned = true
+		}
+		req.Header[key] = append([]string(nil), values...)
+	}
+	return i.next.RoundTrip(req)
+}
+
+// ClientWithMaxResponseBytes returns a client like the one returned by Client,
+// but which limits the size of response bodies to n bytes. Once a caller has
+// read n bytes of a larger body, further reads fail with an
+// [*http.MaxBytesError]. Closing the body still closes the underlying
+// response body.
+//
+// This is useful for testing code that guards against oversized responses.
+func (s *Server) ClientWithMaxResponseBytes(n int64) *http.Client {
+	return &http.Client{Transport: &bodyLimiter{
+		limit: n,
+		next:  s.Transport(),
+	}}
+}
+
+type bodyLimiter struct {
+	limit int64
+	next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (l *bodyLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := l.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, limit: l.limit, remaining: l.limit}
+	return res, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+
+	limit     int64
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(bs []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	// Read one byte more than the limit, to see if the body is too large.
+	if int64(len(bs)) > b.remaining+1 {
+		bs = bs[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(bs)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		b.err = err
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	b.err = &http.MaxBytesError{Limit: b.limit}
+	return n, b.err
+}
+
+// ClientWithRedirectTrace returns a client like the one returned by Client,
+// along with a function that reports the redirect chain the client most
+// recently followed: the URL of the original request, then the target of
+// each redirect in order, ending with the final destination. Requests that
+// aren't redirected don't change the trace. Like the default client, the
+// returned client stops after 10 consecutive redirects.
+//
+// Redirects to the server's own host are served in memory; redirects to other
+// hosts fail to dial.
+func (s *Server) ClientWithRedirectTrace() (*http.Client, func() []*url.URL) {
+	tr := &redirectTrace{}
+	client := &http.Client{
+		Transport:     s.Transport(),
+		CheckRedirect: tr.check,
+	}
+	return client, tr.urls
+}
+
+type redirectTrace struct {
+	mu    sync.Mutex
+	chain []*url.URL
+}
+
+func (t *redirectTrace) check(req *http.Request, via []*http.Request) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(via) == 1 {
+		t.chain = []*url.URL{cloneURL(via[0].URL)}
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	t.chain = append(t.chain, cloneURL(req.URL))
+	return nil
+}
+
+func (t *redirectTrace) urls() []*url.URL {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	urls := make([]*url.URL, len(t.chain))
+	for i, u := range t.chain {
+		urls[i] = cloneURL(u)
+	}
+	return urls
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	cloned := *u
+	if u.User != nil {
+		user := *u.User
+		cloned.User = &user
+	}
+	return &cloned
+}
@@ -0,0 +1,19 @@
+package memhttp
+
+import "time"
+
+// A Clock tells time. Servers use it for all the timing-sensitive behavior
+// they implement themselves, like connection deadlines, so tests can
+// substitute a fake clock to trigger timeouts deterministically.
+//
+// Note that net/http computes its own deadlines (for example, from
+// [http.Server.ReadTimeout]) using the real time.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
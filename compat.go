@@ -0,0 +1,40 @@
+package memhttp
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// CompatServer mimics the API of [net/http/httptest.Server], so code written
+// against httptest can switch to memhttp by changing only the constructor. It
+// embeds a Server, so the rest of memhttp's API is available too.
+type CompatServer struct {
+	*Server
+
+	// URL is the base URL of the server, as returned by Server.URL. Unlike
+	// httptest, it never includes a port.
+	URL string
+}
+
+// NewCompat constructs and starts a CompatServer.
+func NewCompat(handler http.Handler, opts ...Option) (*CompatServer, error) {
+	s, err := New(handler, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CompatServer{Server: s, URL: s.URL()}, nil
+}
+
+// Close shuts down the server, blocking until all outstanding requests on the
+// server have completed. Like httptest.Server's Close, it doesn't return an
+// error; to check for errors, use Shutdown.
+func (s *CompatServer) Close() {
+	_ = s.Server.Shutdown(context.Background())
+}
+
+// Certificate returns the certificate that the server's clients trust, or nil
+// if the server doesn't use TLS.
+func (s *CompatServer) Certificate() *x509.Certificate {
+	return s.Server.certificate
+}
@@ -0,0 +1,481 @@
+package memhttp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeConfig customizes the pipes created by newPipe. The zero value creates
+// a synchronous pipe.
+type pipeConfig struct {
+	// If maxRead is positive, each Read on either end returns at most maxRead
+	// bytes.
+	maxRead int
+	// If idleTimeout is positive, both ends close once no data has flowed in
+	// either direction for that long, as if a NAT or firewall had reaped the
+	// connection.
+	idleTimeout time.Duration
+	// If bufferSize is positive, each direction buffers up to bufferSize
+	// unread bytes, and Writes return as soon as their data fits in the
+	// buffer.
+	bufferSize int
+	// If latency is positive, each Write waits that long before delivering
+	// its data, as if it were crossing a slow network.
+	latency time.Duration
+	// If bandwidth is positive, Writes on each end are paced to deliver at
+	// most bandwidth bytes per second.
+	bandwidth int
+}
+
+// newPipe creates a full-duplex, in-memory connection. By default, it's
+// synchronous: like net.Pipe, each Write blocks until the data has been
+// consumed by one or more Reads on the other end. Unlike net.Pipe, deadlines
+// are driven by the supplied Clock, and the ends never deadlock by writing to
+// each other simultaneously: when both are blocked in Write, one of the
+// writes completes and leaves its data buffered, as a kernel socket buffer
+// would. (This commonly happens when both ends of a TLS connection close at
+// once.)
+//
+// Closing either end makes pending and future Reads on the other end return
+// io.EOF once buffered data is consumed, so net/http notices abrupt
+// disconnects and cancels the affected requests' contexts.
+func newPipe(clock Clock, cfg pipeConfig) (server, client *memoryConn) {
+	toServer, toClient := newStream(cfg.bufferSize), newStream(cfg.bufferSize)
+	server = newMemoryConn(clock, toServer, toClient)
+	client = newMemoryConn(clock, toClient, toServer)
+	server.maxRead, client.maxRead = cfg.maxRead, cfg.maxRead
+	server.latency, client.latency = cfg.latency, cfg.latency
+	server.bandwidth, client.bandwidth = cfg.bandwidth, cfg.bandwidth
+	if cfg.idleTimeout > 0 {
+		r := &idleReaper{clock: clock, timeout: cfg.idleTimeout}
+		r.touch()
+		server.idle, client.idle = r, r
+		go r.run(server, client)
+	}
+	return server, client
+}
+
+// idleReaper closes a pipe after a period of inactivity.
+type idleReaper struct {
+	clock   Clock
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last read or write
+}
+
+// touch records activity on the pipe. It's safe to call on a nil reaper.
+func (r *idleReaper) touch() {
+	if r != nil {
+		r.last.Store(r.clock.Now().UnixNano())
+	}
+}
+
+// run closes both ends once the pipe has been idle for r.timeout. It returns
+// early if either end closes.
+func (r *idleReaper) run(server, client *memoryConn) {
+	for {
+		wait := time.Unix(0, r.last.Load()).Add(r.timeout).Sub(r.clock.Now())
+		if wait <= 0 {
+			server.Close()
+			client.Close()
+			return
+		}
+		select {
+		case <-r.clock.After(wait):
+		case <-server.closed:
+			return
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+// memoryConn is one end of an in-memory pipe.
+type memoryConn struct {
+	rd    *stream // data flowing to this end
+	wr    *stream // data flowing from this end
+	clock Clock
+
+	maxRead       int           // zero means unlimited
+	latency       time.Duration // added to each Write
+	bandwidth     int           // bytes per second; zero means unlimited
+	nextSend      time.Time     // when bandwidth is next free; guarded by wmu
+	idle          *idleReaper   // nil unless the pipe has an idle timeout
+	wmu           sync.Mutex    // serializes Writes
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closeOnce     sync.Once
+	closed        chan struct{}
+}
+
+func newMemoryConn(clock Clock, rd, wr *stream) *memoryConn {
+	return &memoryConn{
+		rd:            rd,
+		wr:            wr,
+		clock:         clock,
+		readDeadline:  newDeadline(clock),
+		writeDeadline: newDeadline(clock),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Read implements net.Conn.
+func (c *memoryConn) Read(bs []byte) (int, error) {
+	n, err := c.read(bs)
+	if err != nil && err != io.EOF {
+		err = &net.OpError{Op: "read", Net: "memory", Err: err}
+	}
+	return n, err
+}
+
+func (c *memoryConn) read(bs []byte) (int, error) {
+	if c.maxRead > 0 && len(bs) > c.maxRead {
+		bs = bs[:c.maxRead]
+	}
+	s := c.rd
+	for {
+		switch {
+		case isClosed(c.closed):
+			return 0, io.ErrClosedPipe
+		case isClosed(c.readDeadline.wait()):
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(bs)
+			s.consumed += int64(n)
+			s.broadcast()
+			s.mu.Unlock()
+			c.idle.touch()
+			return n, nil
+		}
+		if s.writerClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-c.readDeadline.wait():
+		case <-c.closed:
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (c *memoryConn) Write(bs []byte) (int, error) {
+	n, err := c.write(bs)
+	if err != nil {
+		err = &net.OpError{Op: "write", Net: "memory", Err: err}
+	}
+	return n, err
+}
+
+func (c *memoryConn) write(bs []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	switch {
+	case isClosed(c.closed):
+		return 0, io.ErrClosedPipe
+	case isClosed(c.writeDeadline.wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := c.sleep(c.latency); err != nil {
+		return 0, err
+	}
+	if c.bandwidth <= 0 {
+		return c.deliver(bs)
+	}
+	// Pace the write in chunks, each worth about 20ms of bandwidth, so the
+	// reader sees data arrive steadily.
+	chunkSize := max(1, c.bandwidth/50)
+	var total int
+	for len(bs) > 0 {
+		chunk := bs[:min(len(bs), chunkSize)]
+		if err := c.sleep(c.pace(len(chunk))); err != nil {
+			return total, err
+		}
+		n, err := c.deliver(chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		bs = bs[len(chunk):]
+	}
+	return total, nil
+}
+
+// pace reserves bandwidth for n bytes, returning how long the caller must
+// wait before sending them. The caller must hold c.wmu.
+func (c *memoryConn) pace(n int) time.Duration {
+	now := c.clock.Now()
+	if c.nextSend.Before(now) {
+		c.nextSend = now
+	}
+	c.nextSend = c.nextSend.Add(time.Duration(n) * time.Second / time.Duration(c.bandwidth))
+	return c.nextSend.Sub(now)
+}
+
+// sleep waits for d, unless the write deadline passes or the conn closes
+// first.
+func (c *memoryConn) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-c.clock.After(d):
+		return nil
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// deliver hands bs to the reader, waiting until the stream's buffer has room
+// for it. The caller must hold c.wmu.
+func (c *memoryConn) deliver(bs []byte) (int, error) {
+	s := c.wr
+	s.mu.Lock()
+	if s.readerClosed || s.writerClosed {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	c.idle.touch()
+	s.buf.Write(bs)
+	s.written += int64(len(bs))
+	end := s.written
+	s.broadcast()
+	defer s.writerBlocked.Store(false)
+	for {
+		if s.consumed >= end-int64(s.capacity) {
+			s.mu.Unlock()
+			return len(bs), nil
+		}
+		// If the other end is also blocked writing, neither will ever read.
+		// Leave our data buffered and return.
+		s.writerBlocked.Store(true)
+		if c.rd.writerBlocked.Load() {
+			s.mu.Unlock()
+			return len(bs), nil
+		}
+		var err error
+		switch {
+		case s.readerClosed:
+			err = io.ErrClosedPipe
+		case isClosed(c.closed):
+			err = io.ErrClosedPipe
+		case isClosed(c.writeDeadline.wait()):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			// Withdraw the bytes of this write that the reader hasn't
+			// consumed, so they're never delivered. Earlier writes may also
+			// have left data buffered; that data stays.
+			unread := min(int(end-s.consumed), len(bs))
+			if !s.readerClosed {
+				s.buf.Truncate(s.buf.Len() - unread)
+				s.written -= int64(unread)
+			}
+			s.mu.Unlock()
+			return len(bs) - unread, err
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-c.writeDeadline.wait():
+		case <-c.closed:
+		}
+		s.mu.Lock()
+	}
+}
+
+// Close implements net.Conn.
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.wr.closeWriter()
+		c.rd.closeReader()
+	})
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection, like
+// [net.TCPConn.CloseWrite]. Once the other end has read any buffered data,
+// its Reads return io.EOF, but it can still write to this end. Later Writes
+// on this end fail.
+func (c *memoryConn) CloseWrite() error {
+	if isClosed(c.closed) {
+		return &net.OpError{Op: "close", Net: "memory", Err: io.ErrClosedPipe}
+	}
+	c.wr.closeWriter()
+	return nil
+}
+
+// broken reports whether either end of the pipe has closed.
+func (c *memoryConn) broken() bool {
+	if isClosed(c.closed) {
+		return true
+	}
+	c.rd.mu.Lock()
+	defer c.rd.mu.Unlock()
+	return c.rd.writerClosed
+}
+
+// LocalAddr implements net.Conn.
+func (c *memoryConn) LocalAddr() net.Addr { return &memoryAddr{} }
+
+// RemoteAddr implements net.Conn.
+func (c *memoryConn) RemoteAddr() net.Addr { return &memoryAddr{} }
+
+// SetDeadline implements net.Conn.
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	if isClosed(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	if isClosed(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	if isClosed(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// stream is one direction of a pipe.
+type stream struct {
+	mu           sync.Mutex
+	buf          bytes.Buffer
+	written      int64 // total bytes ever written
+	consumed     int64 // total bytes ever read
+	writerClosed bool
+	readerClosed bool
+	changed      chan struct{} // closed and replaced on every state change
+	capacity     int           // unread bytes a Write may leave buffered
+
+	writerBlocked atomic.Bool // a Write is waiting for the reader
+}
+
+func newStream(capacity int) *stream {
+	return &stream{changed: make(chan struct{}), capacity: capacity}
+}
+
+// broadcast wakes all goroutines waiting for the stream's state to change.
+// The caller must hold s.mu.
+func (s *stream) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stream) closeWriter() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writerClosed = true
+	s.broadcast()
+}
+
+func (s *stream) closeReader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readerClosed = true
+	s.buf = bytes.Buffer{}
+	s.broadcast()
+}
+
+// deadline is a resettable deadline, driven by a Clock.
+type deadline struct {
+	clock   Clock
+	mu      sync.Mutex
+	gen     uint64        // incremented on every set, to ignore stale timers
+	expired chan struct{} // closed when the deadline passes
+	stop    func()        // stops the pending timer, if any
+}
+
+func newDeadline(clock Clock) *deadline {
+	return &deadline{
+		clock:   clock,
+		expired: make(chan struct{}),
+	}
+}
+
+// set resets the deadline. The zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	if d.stop != nil {
+		d.stop()
+		d.stop = nil
+	}
+	if isClosed(d.expired) {
+		d.expired = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	dur := t.Sub(d.clock.Now())
+	if dur <= 0 {
+		close(d.expired)
+		return
+	}
+	gen, expired := d.gen, d.expired
+	fire := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gen == gen && !isClosed(expired) {
+			close(expired)
+		}
+	}
+	if _, ok := d.clock.(realClock); ok {
+		timer := time.AfterFunc(dur, fire)
+		d.stop = func() { timer.Stop() }
+		return
+	}
+	// Register with the clock before returning, so that fake clocks advanced
+	// immediately after set still fire.
+	after, cancel := d.clock.After(dur), make(chan struct{})
+	d.stop = func() { close(cancel) }
+	go func() {
+		select {
+		case <-after:
+			fire()
+		case <-cancel:
+		}
+	}()
+}
+
+// wait returns a channel that's closed when the deadline passes.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,437 @@
+package memhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DrainConns asks clients to stop using the server's existing connections,
+// so that subsequent requests open new ones. Idle connections are closed
+// immediately. Active connections keep serving requests, including new
+// HTTP/2 streams, but each one's next response carries a "Connection: close"
+// header, which makes net/http send GOAWAY (for HTTP/2) or close the
+// connection after the response (for HTTP/1.1). Active connections are also
+// closed as soon as they become idle.
+//
+// DrainConns doesn't send GOAWAY itself, since net/http doesn't expose a way
+// to gracefully shut down a single HTTP/2 connection.
+func (s *Server) DrainConns() {
+	s.conns.drain()
+}
+
+// LastCipherSuite returns the TLS cipher suite negotiated by the server's most
+// recent handshake, or zero if the server doesn't use TLS or hasn't completed
+// any handshakes. Use [tls.CipherSuiteName] to get the suite's name.
+func (s *Server) LastCipherSuite() uint16 {
+	return uint16(s.conns.lastCipherSuite.Load())
+}
+
+// StreamResets returns the number of HTTP/2 streams the server has seen
+// reset by clients (for example, because the client cancelled the request)
+// while their handlers were running. Streams that end because the whole
+// connection closed aren't counted. Each reset is counted when the handler's
+// context is cancelled with [ErrRequestCanceled]. It's useful for confirming
+// that cancellation propagated to the server, rather than just ending the
+// client's wait.
+func (s *Server) StreamResets() int64 {
+	return s.conns.streamResets.Load()
+}
+
+// Stats counts the server's connections and requests.
+type Stats struct {
+	// ActiveConns is the number of connections the server is currently
+	// serving, whether active or idle. Hijacked connections aren't included.
+	ActiveConns int
+	// TotalConns is the number of connections the server has accepted.
+	TotalConns int64
+	// TotalRequests is the number of requests the server has started
+	// handling.
+	TotalRequests int64
+}
+
+// Stats reports how many connections and requests the server has handled.
+// It's useful for assertions about connection reuse: for example, that a
+// client sent many requests over a few keep-alive connections, and that those
+// connections closed once they went idle (see WithConnIdleTimeout).
+func (s *Server) Stats() Stats {
+	return s.conns.stats()
+}
+
+var (
+	// ErrRequestCanceled is the cause of a request context's cancellation
+	// (see [context.Cause]) when the client cancelled the request but kept the
+	// connection open, as HTTP/2 clients do by resetting the stream.
+	ErrRequestCanceled = errors.New("memhttp: client canceled request")
+	// ErrConnClosed is the cause of a request context's cancellation when the
+	// connection carrying the request closed. HTTP/1.1 clients cancel requests
+	// by closing the connection, so cancelled HTTP/1.1 requests always report
+	// this cause. Connections closed by the server, for example by
+	// [Server.Close], report it too.
+	ErrConnClosed = errors.New("memhttp: connection closed")
+)
+
+// ConnFromContext returns the connection carrying a request. Handlers can
+// call it with the request's context. Unless the server was constructed
+// WithoutTLS, the connection is a *tls.Conn wrapping the in-memory connection.
+// Connections report "memory" as their addresses' network.
+//
+// Manipulating the connection while net/http is serving it is risky. For
+// example, setting deadlines may interfere with net/http's own timeouts,
+// writing directly may corrupt the response, and closing the connection fails
+// all requests using it (including other HTTP/2 streams). It's most useful
+// for simulating stalls and failures in tests.
+func ConnFromContext(ctx context.Context) (net.Conn, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return nil, false
+	}
+	return info.conn, true
+}
+
+type connInfoKey struct{}
+
+// connInfo tracks the state of one server-side connection.
+type connInfo struct {
+	conn net.Conn
+	base context.Context // from http.Server.BaseContext
+
+	mu       sync.Mutex
+	state    http.ConnState
+	draining bool
+	requests int
+}
+
+func (c *connInfo) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// connTracker tracks all the server's live connections. It's wired into the
+// http.Server's ConnContext and ConnState hooks.
+type connTracker struct {
+	maxRequests int // per connection; zero means unlimited
+	clock       Clock
+	strictTLS   bool
+
+	mu           sync.Mutex
+	conns        map[net.Conn]*connInfo
+	inFlight     map[*InFlightRequest]struct{}
+	changed      chan struct{} // closed and replaced when inFlight changes
+	handshakeErr error         // first failure, if strictTLS
+
+	lastCipherSuite atomic.Uint32
+	streamResets    atomic.Int64
+	totalConns      atomic.Int64
+	totalRequests   atomic.Int64
+}
+
+func newConnTracker(maxRequests int, clock Clock, strictTLS bool) *connTracker {
+	return &connTracker{
+		maxRequests: maxRequests,
+		clock:       clock,
+		strictTLS:   strictTLS,
+		conns:       make(map[net.Conn]*connInfo),
+		inFlight:    make(map[*InFlightRequest]struct{}),
+		changed:     make(chan struct{}),
+	}
+}
+
+// connContext implements http.Server.ConnContext.
+func (t *connTracker) connContext(ctx context.Context, conn net.Conn) context.Context {
+	info := &connInfo{conn: conn, base: ctx, state: http.StateNew}
+	t.totalConns.Add(1)
+	t.mu.Lock()
+	t.conns[conn] = info
+	t.mu.Unlock()
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// connState implements http.Server.ConnState.
+func (t *connTracker) connState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	info, ok := t.conns[conn]
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(t.conns, conn)
+	}
+	t.mu.Unlock()
+	if state == http.StateClosed && t.strictTLS {
+		t.recordHandshake(conn)
+	}
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	info.state = state
+	drained := state == http.StateIdle && info.draining
+	info.mu.Unlock()
+	if drained {
+		conn.Close()
+	}
+}
+
+// recordHandshake records the first failed TLS handshake. By the time a
+// connection closes, net/http has attempted the handshake, and tls.Conn
+// returns the original error from subsequent calls to Handshake.
+func (t *connTracker) recordHandshake(conn net.Conn) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok || tc.ConnectionState().HandshakeComplete {
+		return
+	}
+	err := tc.Handshake()
+	if err == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.handshakeErr == nil {
+		t.handshakeErr = fmt.Errorf("tls handshake: %w", err)
+	}
+}
+
+func (t *connTracker) handshakeError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.handshakeErr
+}
+
+// verifyConnection implements tls.Config.VerifyConnection, recording the
+// outcome of each handshake.
+func (t *connTracker) verifyConnection(state tls.ConnectionState) error {
+	t.lastCipherSuite.Store(uint32(state.CipherSuite))
+	return nil
+}
+
+// requireALPN wraps a [tls.Config.VerifyConnection] function, rejecting
+// connections that didn't negotiate one of protos.
+func requireALPN(protos []string, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if !slices.Contains(protos, state.NegotiatedProtocol) {
+			return fmt.Errorf("memhttp: client didn't negotiate a required protocol %q", protos)
+		}
+		return next(state)
+	}
+}
+
+// connBroken reports whether either end of conn has closed. Connections that
+// aren't in-memory pipes are assumed to be broken.
+func connBroken(conn net.Conn) bool {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	mc, ok := conn.(*memoryConn)
+	return !ok || mc.broken()
+}
+
+// cancelCause explains why net/http cancelled the context of r, a request on
+// info's connection, while its handler was running.
+func (t *connTracker) cancelCause(r *http.Request, info *connInfo) error {
+	if info.base.Err() != nil {
+		// The server's base context (see WithBaseContext) ended.
+		return context.Cause(info.base)
+	}
+	if cause := context.Cause(r.Context()); cause != context.Canceled {
+		// For example, a deadline from the base context passed.
+		return cause
+	}
+	// HTTP/1.1 servers only cancel requests when the connection closes. By
+	// the time net/http notices a broken connection, the in-memory pipe
+	// already reports it.
+	if r.ProtoMajor < 2 || connBroken(info.conn) {
+		return ErrConnClosed
+	}
+	t.streamResets.Add(1)
+	return ErrRequestCanceled
+}
+
+// requestContext is a request's context with a cancellation cause. It reports
+// the deadline of the original request context, which relays its
+// cancellation.
+type requestContext struct {
+	context.Context
+	parent context.Context
+}
+
+// Deadline implements context.Context.
+func (c *requestContext) Deadline() (time.Time, bool) {
+	return c.parent.Deadline()
+}
+
+func (t *connTracker) drain() {
+	t.mu.Lock()
+	infos := make([]*connInfo, 0, len(t.conns))
+	for _, info := range t.conns {
+		infos = append(infos, info)
+	}
+	t.mu.Unlock()
+	for _, info := range infos {
+		info.mu.Lock()
+		info.draining = true
+		idle := info.state == http.StateIdle
+		info.mu.Unlock()
+		// Like http.Server.SetKeepAlivesEnabled, close idle connections.
+		// net/http doesn't let us send GOAWAY on an idle HTTP/2 connection,
+		// and clients open a new connection either way. Active connections
+		// close once they're idle (see connState).
+		if idle {
+			info.conn.Close()
+		}
+	}
+}
+
+// wrap closes connections after their in-flight responses if they're
+// draining or have served the maximum number of requests.
+func (t *connTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.totalRequests.Add(1)
+		info, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info.mu.Lock()
+		info.requests++
+		last := t.maxRequests > 0 && info.requests >= t.maxRequests
+		info.mu.Unlock()
+		req := &InFlightRequest{
+			Method:  r.Method,
+			URL:     r.Host + r.URL.RequestURI(),
+			Path:    r.URL.Path,
+			Proto:   r.Proto,
+			Started: t.clock.Now(),
+		}
+		t.mu.Lock()
+		t.inFlight[req] = struct{}{}
+		t.notifyLocked()
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.inFlight, req)
+			t.notifyLocked()
+			t.mu.Unlock()
+		}()
+		// Record why the request's context ended. net/http cancels request
+		// contexts without a cause, and a cause can't be attached once a
+		// context is cancelled, so relay r.Context()'s cancellation to a
+		// context that carries one.
+		ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+		stop := context.AfterFunc(r.Context(), func() {
+			cancel(t.cancelCause(r, info))
+		})
+		defer func() {
+			stop()
+			cancel(nil)
+		}()
+		hw := &headerWriter{
+			ResponseWriter: w,
+			beforeHeader: func(h http.Header) {
+				if last || info.isDraining() {
+					h.Set("Connection", "close")
+				}
+			},
+		}
+		next.ServeHTTP(hw, r.WithContext(&requestContext{Context: ctx, parent: r.Context()}))
+		hw.commit() // in case the handler wrote nothing
+	})
+}
+
+func (t *connTracker) stats() Stats {
+	t.mu.Lock()
+	active := len(t.conns)
+	t.mu.Unlock()
+	return Stats{
+		ActiveConns:   active,
+		TotalConns:    t.totalConns.Load(),
+		TotalRequests: t.totalRequests.Load(),
+	}
+}
+
+func (t *connTracker) inFlightCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inFlight)
+}
+
+// watchInFlight returns the number of requests in flight and a channel that's
+// closed when that number next changes.
+func (t *connTracker) watchInFlight() (int, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inFlight), t.changed
+}
+
+func (t *connTracker) notifyLocked() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// active returns the requests currently being handled, oldest first, with
+// elapsed times measured as of the call.
+func (t *connTracker) active() []InFlightRequest {
+	t.mu.Lock()
+	reqs := make([]InFlightRequest, 0, len(t.inFlight))
+	for req := range t.inFlight {
+		reqs = append(reqs, *req)
+	}
+	t.mu.Unlock()
+	now := t.clock.Now()
+	for i := range reqs {
+		reqs[i].Elapsed = now.Sub(reqs[i].Started)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Started.Before(reqs[j].Started) })
+	return reqs
+}
+
+// ActiveRequests returns the requests the server is currently handling,
+// oldest first. Elapsed times are measured with the server's Clock, as of the
+// call to ActiveRequests. It's useful for finding hung handlers, especially
+// when Shutdown times out.
+func (s *Server) ActiveRequests() []InFlightRequest {
+	return s.conns.active()
+}
+
+// InFlightRequest describes a request that a server is handling. It's
+// returned by ActiveRequests and included in ShutdownError.
+type InFlightRequest struct {
+	Method  string
+	URL     string // host and request URI
+	Path    string
+	Proto   string
+	Started time.Time
+	Elapsed time.Duration // as of the snapshot
+}
+
+// ShutdownError is returned by Shutdown (and Cleanup) if the context ends
+// before all in-flight requests finish. It lists the requests that were still
+// being handled, which helps diagnose hung handlers.
+type ShutdownError struct {
+	Err      error // usually from the context
+	InFlight []InFlightRequest
+}
+
+// Error implements error.
+func (e *ShutdownError) Error() string {
+	if len(e.InFlight) == 0 {
+		return fmt.Sprintf("shutdown: %v", e.Err)
+	}
+	descs := make([]string, len(e.InFlight))
+	for i, r := range e.InFlight {
+		descs[i] = fmt.Sprintf("%s %s %s (started %s)", r.Method, r.URL, r.Proto, r.Started.Format(time.RFC3339Nano))
+	}
+	return fmt.Sprintf("shutdown: %v; %d requests in flight: %s", e.Err, len(descs), strings.Join(descs, ", "))
+}
+
+// Unwrap returns the underlying error.
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,116 @@
+package memhttp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+)
+
+// A FlushStrategy controls how the server batches response bodies before
+// sending them to the client. The zero value uses net/http's default
+// buffering, which sends data when its internal buffer (a few KiB) fills or
+// the handler calls Flush.
+type FlushStrategy struct {
+	threshold int
+}
+
+// FlushImmediately sends each of the handler's writes to the client as soon
+// as it's made, modeling a chatty streaming server.
+func FlushImmediately() FlushStrategy {
+	return FlushStrategy{threshold: 1}
+}
+
+// FlushAtSize buffers the handler's writes until at least n bytes are
+// pending, then sends them to the client together, modeling a server that
+// batches output. Explicit calls to Flush and the end of the response send
+// any pending data.
+func FlushAtSize(n int) FlushStrategy {
+	if n < 1 {
+		n = 1
+	}
+	return FlushStrategy{threshold: n}
+}
+
+func (s FlushStrategy) wrap(next http.Handler) http.Handler {
+	if s.threshold == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fw := &flushWriter{ResponseWriter: w, threshold: s.threshold}
+		next.ServeHTTP(fw, r)
+		// Let net/http finish the response normally.
+		fw.writePending()
+	})
+}
+
+// flushWriter buffers writes until threshold bytes are pending, then writes
+// and flushes them.
+type flushWriter struct {
+	http.ResponseWriter
+
+	threshold   int
+	buf         bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *flushWriter) WriteHeader(code int) {
+	// Informational responses don't commit the status.
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *flushWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		// As net/http does, commit the status on the first Write, even if the
+		// data is buffered. Later calls to WriteHeader have no effect.
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf.Len()+len(bs) < w.threshold {
+		return w.buf.Write(bs)
+	}
+	pending := w.buf.Len()
+	if pending > 0 {
+		w.buf.Write(bs)
+		bs = w.buf.Bytes()
+	}
+	n, err := w.ResponseWriter.Write(bs)
+	w.buf.Reset()
+	w.flushUnderlying()
+	if n -= pending; n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (w *flushWriter) Flush() {
+	w.writePending()
+	w.flushUnderlying()
+}
+
+func (w *flushWriter) writePending() {
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+func (w *flushWriter) flushUnderlying() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so handlers that type-assert for it keep
+// working. It returns an error if the underlying ResponseWriter doesn't
+// support hijacking, as HTTP/2 ResponseWriters don't.
+func (w *flushWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.writePending()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
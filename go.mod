@@ -1,6 +1,6 @@
 module go.akshayshah.org/memhttp
 
-go 1.19
+go 1.24
 
 require go.akshayshah.org/attest v1.0.2
 
@@ -0,0 +1,316 @@
+package memhttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harBodyLimit is the maximum number of request or response body bytes
+// captured per exchange. Longer bodies are truncated.
+const harBodyLimit = 64 * 1024
+
+// WriteHAR serializes the exchanges the server has handled to w as an HTTP
+// Archive (HAR 1.2) document, suitable for loading into browser developer
+// tools. Only the most recent 1,000 exchanges are retained, and they're timed
+// with the server's Clock. It returns an error unless the server was
+// constructed with WithHARCapture.
+func (s *Server) WriteHAR(w io.Writer) error {
+	if s.har == nil {
+		return errors.New("memhttp: HAR capture not enabled")
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s.har.archive())
+}
+
+type harRecorder struct {
+	clock Clock
+
+	mu      sync.Mutex
+	entries []harEntry // at most maxRecentRequests, oldest first
+}
+
+func (h *harRecorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := h.clock.Now()
+		reqBody := &cappedBuffer{limit: harBodyLimit}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeBody{ReadCloser: r.Body, w: reqBody}
+		}
+		rw := &harWriter{ResponseWriter: w, body: &cappedBuffer{limit: harBodyLimit}}
+		next.ServeHTTP(rw, r)
+		h.record(start, h.clock.Now().Sub(start), r, reqBody, rw)
+	})
+}
+
+func (h *harRecorder) record(start time.Time, elapsed time.Duration, r *http.Request, reqBody *cappedBuffer, rw *harWriter) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.header == nil {
+		rw.header = rw.Header().Clone()
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         scheme + "://" + r.Host + r.URL.RequestURI(),
+			HTTPVersion: r.Proto,
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(r.Header),
+			QueryString: harQuery(r),
+			HeadersSize: -1,
+			BodySize:    reqBody.total,
+		},
+		Response: harResponse{
+			Status:      rw.status,
+			StatusText:  http.StatusText(rw.status),
+			HTTPVersion: r.Proto,
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(rw.header),
+			Content:     harContentFrom(rw.header.Get("Content-Type"), rw.body),
+			RedirectURL: rw.header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    rw.body.total,
+		},
+		Cache:   struct{}{},
+		Timings: harTimings{Send: 0, Wait: ms, Receive: 0},
+	}
+	if reqBody.total > 0 {
+		content := harContentFrom(r.Header.Get("Content-Type"), reqBody)
+		entry.Request.PostData = &harPostData{
+			MimeType: content.MimeType,
+			Text:     content.Text,
+			Comment:  content.Comment,
+		}
+	}
+	h.mu.Lock()
+	if len(h.entries) == maxRecentRequests {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, entry)
+	h.mu.Unlock()
+}
+
+func (h *harRecorder) archive() harArchive {
+	h.mu.Lock()
+	entries := make([]harEntry, len(h.entries))
+	copy(entries, h.entries)
+	h.mu.Unlock()
+	return harArchive{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "memhttp", Version: "1"},
+		Entries: entries,
+	}}
+}
+
+type harWriter struct {
+	http.ResponseWriter
+
+	status int
+	header http.Header // snapshot taken when headers are written
+	body   *cappedBuffer
+}
+
+func (w *harWriter) WriteHeader(code int) {
+	// Informational responses precede the final status.
+	informational := code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+	if w.status == 0 && !informational {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *harWriter) Write(bs []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(bs)
+	w.body.Write(bs[:n])
+	return n, err
+}
+
+func (w *harWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so that CONNECT and WebSocket handlers work
+// when exchanges are recorded.
+func (w *harWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *harWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cappedBuffer retains at most limit bytes, but counts all bytes written.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	total int64
+}
+
+func (b *cappedBuffer) Write(bs []byte) (int, error) {
+	b.total += int64(len(bs))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(bs) > room {
+			b.buf.Write(bs[:room])
+		} else {
+			b.buf.Write(bs)
+		}
+	}
+	return len(bs), nil
+}
+
+func (b *cappedBuffer) truncated() bool {
+	return b.total > int64(b.buf.Len())
+}
+
+type teeBody struct {
+	io.ReadCloser
+
+	w io.Writer
+}
+
+func (t *teeBody) Read(bs []byte) (int, error) {
+	n, err := t.ReadCloser.Read(bs)
+	if n > 0 {
+		t.w.Write(bs[:n])
+	}
+	return n, err
+}
+
+type harArchive struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harCookie  `json:"cookies"`
+	Headers     []harNVP     `json:"headers"`
+	QueryString []harNVP     `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []harNVP    `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harNVP struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harNVP {
+	nvps := make([]harNVP, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			nvps = append(nvps, harNVP{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nvps, func(i, j int) bool { return nvps[i].Name < nvps[j].Name })
+	return nvps
+}
+
+func harQuery(r *http.Request) []harNVP {
+	query := r.URL.Query()
+	nvps := make([]harNVP, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			nvps = append(nvps, harNVP{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nvps, func(i, j int) bool { return nvps[i].Name < nvps[j].Name })
+	return nvps
+}
+
+func harContentFrom(mimeType string, body *cappedBuffer) harContent {
+	content := harContent{Size: body.total, MimeType: mimeType}
+	if bs := body.buf.Bytes(); utf8.Valid(bs) {
+		content.Text = string(bs)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(bs)
+		content.Encoding = "base64"
+	}
+	if body.truncated() {
+		content.Comment = "body truncated by memhttp"
+	}
+	return content
+}
@@ -0,0 +1,118 @@
+package memhttp
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LatencyStats summarizes how long the server's handlers took to respond.
+// Percentiles are estimated from a histogram whose buckets are about 9% wide,
+// so they may overstate the true value by up to that much (but never exceed
+// Max).
+type LatencyStats struct {
+	Count int64
+	Min   time.Duration
+	Max   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// LatencyStats reports the distribution of handler durations for all the
+// requests the server has finished handling. Durations are measured with the
+// server's Clock, from the start of the handler until it returns, and include
+// the time spent in middleware configured with options (like
+// WithFlushStrategy). Memory use is constant, however many requests the
+// server handles.
+func (s *Server) LatencyStats() LatencyStats {
+	return s.latency.stats()
+}
+
+const (
+	bucketsPerDoubling = 8
+	// With 1µs as the smallest bucket, 320 buckets cover durations up to
+	// about 12 days.
+	latencyBuckets = 40 * bucketsPerDoubling
+	latencyBase    = time.Microsecond
+)
+
+// latencyHistogram is a log-linear histogram of handler durations.
+type latencyHistogram struct {
+	clock Clock
+
+	mu       sync.Mutex
+	count    int64
+	min, max time.Duration
+	buckets  [latencyBuckets]int64
+}
+
+func (h *latencyHistogram) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := h.clock.Now()
+		defer func() {
+			h.record(h.clock.Now().Sub(start))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.buckets[bucketIndex(d)]++
+}
+
+func (h *latencyHistogram) stats() LatencyStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return LatencyStats{
+		Count: h.count,
+		Min:   h.min,
+		Max:   h.max,
+		P50:   h.percentile(0.5),
+		P90:   h.percentile(0.9),
+		P99:   h.percentile(0.99),
+	}
+}
+
+// percentile must be called with h.mu held.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			return min(max(bucketUpperBound(i), h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// bucketIndex returns the bucket for d. Bucket 0 holds durations shorter than
+// latencyBase, and bucket i holds durations up to latencyBase*2^(i/8).
+func bucketIndex(d time.Duration) int {
+	if d < latencyBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(float64(d)/float64(latencyBase))*bucketsPerDoubling)) + 1
+	return min(i, latencyBuckets-1)
+}
+
+func bucketUpperBound(i int) time.Duration {
+	if i == 0 {
+		return latencyBase
+	}
+	return time.Duration(float64(latencyBase) * math.Exp2(float64(i-1)/bucketsPerDoubling))
+}
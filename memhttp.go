@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"os"
 	"sync"
 	"time"
 )
@@ -18,90 +20,435 @@ import (
 // default, it has TLS enabled and supports HTTP/2. It otherwise uses the same
 // configuration as the zero value of [http.Server].
 type Server struct {
-	server         *http.Server
-	listener       *memoryListener
-	certificate    *x509.Certificate // for client
-	url            string
-	disableHTTP2   bool
-	serveErr       chan error
-	cleanupContext func() (context.Context, context.CancelFunc)
+	server           *http.Server
+	listener         *memoryListener
+	plaintext        *memoryListener   // nil unless serving both HTTP and HTTPS
+	certificate      *x509.Certificate // root trusted by clients
+	leaf             *x509.Certificate // presented by the server
+	serverName       string            // for client verification, if not the URL's host
+	url              string
+	disableHTTP2     bool
+	h2c              bool
+	serveDone        chan struct{} // closed after serveErr is set
+	serveErr         error
+	listeners        []net.Listener
+	startOnce        sync.Once
+	cleanupContext   func() (context.Context, context.CancelFunc)
+	har              *harRecorder
+	readBuffer       int
+	writeBuffer      int
+	maxIdle          int
+	maxIdlePerHost   int
+	maxPerHost       int
+	skipHostname     bool
+	http2            *http.HTTP2Config
+	observers        *observers
+	conns            *connTracker
+	bytes            *byteCounts
+	latency          *latencyHistogram
+	order            *handleOrder
+	headers          *requestHeaders
+	handler          *swappableHandler
+	name             string
+	shuttingDown     chan struct{}
+	shutdownOnce     sync.Once
+	hooksMu          sync.Mutex
+	orderedHooks     []func()
+	hooksOnce        sync.Once
+	hooksDone        chan struct{} // closed once ordered hooks return
+	shutdownObserver func(string)
+	clock            Clock
 }
 
 // New constructs and starts a Server.
 func New(handler http.Handler, opts ...Option) (*Server, error) {
-	var cfg config
+	cfg := config{Clock: realClock{}}
 	WithCleanupTimeout(5 * time.Second).apply(&cfg)
+	WithTransportBufferSizes(32*1024, 32*1024).apply(&cfg)
 	for _, opt := range opts {
 		opt.apply(&cfg)
 	}
-	mlis := &memoryListener{
-		conns:  make(chan net.Conn),
-		closed: make(chan struct{}),
+	if cfg.H2C {
+		cfg.DisableTLS = true
 	}
+	if cfg.Name != "" {
+		cfg.ErrorLog = namedLogger(cfg.ErrorLog, cfg.Name)
+	}
+	mlis := newMemoryListener(&cfg)
 	var lis net.Listener = mlis
-	server := &http.Server{Handler: handler}
+	swappable := newSwappableHandler(handler)
+	handler = swappable
+	if cfg.RequestTimeout > 0 {
+		handler = http.TimeoutHandler(handler, cfg.RequestTimeout, "")
+	}
+	if cfg.RecordReplayDir != "" {
+		handler = &recordReplay{dir: cfg.RecordReplayDir, next: handler, logger: cfg.ErrorLog}
+	}
+	if len(cfg.BodyLimits) > 0 {
+		handler = withBodyLimits(cfg.BodyLimits, handler)
+	}
+	if len(cfg.PathLatency) > 0 {
+		handler = withPathLatency(cfg.Clock, cfg.PathLatency, handler)
+	}
+	if len(cfg.ResponseHeaders) > 0 {
+		handler = withResponseHeaders(cfg.ResponseHeaders, handler)
+	}
+	handler = cfg.FlushStrategy.wrap(handler)
+	if cfg.StartupDelay > 0 {
+		ready := cfg.Clock.Now().Add(cfg.StartupDelay)
+		handler = withStartupDelay(cfg.Clock, ready, cfg.StartupBlock, handler)
+	}
+	latency := &latencyHistogram{clock: cfg.Clock}
+	handler = latency.wrap(handler)
+	if cfg.ServerTiming {
+		handler = withServerTiming(cfg.Clock, handler)
+	}
+	if cfg.ClockSkew != 0 {
+		handler = withDate(cfg.Clock, cfg.ClockSkew, handler)
+	}
+	if cfg.ForceChunked {
+		handler = withForceChunked(handler)
+	}
+	var har *harRecorder
+	if cfg.HARCapture {
+		har = &harRecorder{clock: cfg.Clock}
+		handler = har.wrap(handler)
+	}
+	// Record requests after OnRequest observers run, so that recorders see
+	// any changes they make (like memhttptest.Exchange removing its header).
+	var headers *requestHeaders
+	if cfg.HeaderCapture {
+		headers = &requestHeaders{}
+		handler = withObserver(headers.record, handler)
+	}
+	var order *handleOrder
+	if cfg.RequestIDHeader != "" {
+		order = &handleOrder{}
+		handler = withObserver(order.record, handler)
+	}
+	obs := &observers{}
+	handler = obs.wrap(handler)
+	var counts *byteCounts
+	if cfg.RequestIDHeader != "" {
+		counts = &byteCounts{}
+		handler = counts.wrap(handler)
+		handler = withRequestID(cfg.RequestIDHeader, handler)
+	}
+	conns := newConnTracker(cfg.MaxRequestsPerConn, cfg.Clock, cfg.StrictTLS)
+	handler = conns.wrap(handler)
+	shuttingDown := make(chan struct{})
+	server := &http.Server{
+		Handler: handler,
+		BaseContext: func(l net.Listener) context.Context {
+			ctx := context.Background()
+			if cfg.BaseContext != nil {
+				ctx = cfg.BaseContext(l)
+			}
+			return context.WithValue(ctx, shuttingDownKey{}, shuttingDown)
+		},
+		ConnContext: conns.connContext,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			conns.connState(conn, state)
+			if cfg.ConnState != nil {
+				cfg.ConnState(conn, state)
+			}
+		},
+		HTTP2:    cfg.http2Config(),
+		ErrorLog: cfg.ErrorLog,
+	}
+	if cfg.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 
-	var clientCert *x509.Certificate
+	var (
+		rootCert   *x509.Certificate
+		leafCert   *x509.Certificate
+		serverName string
+	)
 	if !cfg.DisableTLS {
-		srvCert, err := tls.X509KeyPair(_cert, _key)
-		if err != nil {
+		var (
+			srvCert tls.Certificate
+			err     error
+		)
+		if cfg.Certificate != nil {
+			srvCert = *cfg.Certificate
+			if len(srvCert.Certificate) == 0 {
+				return nil, errors.New("memhttp: WithCertificate requires a certificate")
+			}
+		} else if srvCert, err = tls.X509KeyPair(_cert, _key); err != nil {
 			return nil, fmt.Errorf("create x509 key pair: %v", err)
 		}
+		leafCert, err = x509.ParseCertificate(srvCert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse x509 certificate: %v", err)
+		}
+		rootCert = leafCert
+		if cfg.Certificate != nil {
+			serverName = verifiableName(leafCert, mlis.Addr().String())
+		} else if cfg.CA != nil || len(cfg.CertSANs) > 0 || !cfg.CertNotAfter.IsZero() || cfg.KeyType != 0 {
+			sans := cfg.CertSANs
+			if len(sans) == 0 {
+				sans = defaultSANs
+			}
+			notBefore, notAfter := cfg.CertNotBefore, cfg.CertNotAfter
+			ca := cfg.CA
+			if notAfter.IsZero() && ca != nil {
+				notBefore, notAfter = ca.cert.Leaf.NotBefore, ca.cert.Leaf.NotAfter
+			} else if notAfter.IsZero() {
+				now := cfg.Clock.Now()
+				notBefore, notAfter = now.Add(-time.Hour), now.AddDate(10, 0, 0)
+			}
+			if ca == nil {
+				ca, err = newCA(notBefore, notAfter)
+				if err != nil {
+					return nil, err
+				}
+			}
+			keyType := cfg.KeyType
+			if keyType == 0 {
+				keyType = ECDSAP256
+			}
+			srvCert, err = ca.issueServer(sans, notBefore, notAfter, keyType)
+			if err != nil {
+				return nil, err
+			}
+			rootCert, leafCert = ca.cert.Leaf, srvCert.Leaf
+			// If the certificate doesn't cover the server's synthetic hostname,
+			// clients must verify it against one of the names it does cover.
+			if leafCert.VerifyHostname(mlis.Addr().String()) != nil {
+				serverName = sans[0]
+			}
+		}
 		protos := []string{"h2"}
 		if cfg.DisableHTTP2 {
 			protos = []string{"http/1.1"}
 		}
+		verify := conns.verifyConnection
+		if len(cfg.RequiredALPN) > 0 {
+			protos = cfg.RequiredALPN
+			verify = requireALPN(protos, verify)
+		}
 		server.TLSConfig = &tls.Config{
-			NextProtos:   protos,
-			Certificates: []tls.Certificate{srvCert},
+			NextProtos:       protos,
+			Certificates:     []tls.Certificate{srvCert},
+			CipherSuites:     cfg.CipherSuites,
+			VerifyConnection: verify,
 		}
-		clientCert, err = x509.ParseCertificate(server.TLSConfig.Certificates[0].Certificate[0])
-		if err != nil {
-			return nil, fmt.Errorf("parse x509 certificate: %v", err)
+		if cfg.ClientCA != nil {
+			server.TLSConfig.ClientCAs = cfg.ClientCA.CertPool()
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		if cfg.TLSConfig != nil {
+			server.TLSConfig = mergeTLSConfig(cfg.TLSConfig, server.TLSConfig)
 		}
 		lis = tls.NewListener(mlis, server.TLSConfig)
 	}
 
-	serveErr := make(chan error, 1)
-	go func() {
-		serveErr <- server.Serve(lis)
-	}()
+	if cfg.ConfigureServer != nil {
+		cfg.ConfigureServer(server)
+	}
+
+	listeners := []net.Listener{lis}
+	var plain *memoryListener
+	if cfg.PlaintextListener && !cfg.DisableTLS {
+		plain = newMemoryListener(&cfg)
+		listeners = append(listeners, plain)
+	}
 
 	scheme := "https://"
 	if cfg.DisableTLS {
 		scheme = "http://"
 	}
-	return &Server{
-		server:         server,
-		listener:       mlis,
-		certificate:    clientCert,
-		url:            scheme + mlis.Addr().String(),
-		disableHTTP2:   cfg.DisableHTTP2,
-		serveErr:       serveErr,
-		cleanupContext: cfg.CleanupContext,
-	}, nil
+	srv := &Server{
+		server:           server,
+		listener:         mlis,
+		plaintext:        plain,
+		certificate:      rootCert,
+		leaf:             leafCert,
+		serverName:       serverName,
+		url:              scheme + mlis.Addr().String(),
+		disableHTTP2:     cfg.DisableHTTP2,
+		h2c:              cfg.H2C,
+		serveDone:        make(chan struct{}),
+		cleanupContext:   cfg.CleanupContext,
+		har:              har,
+		readBuffer:       cfg.ReadBufferSize,
+		writeBuffer:      cfg.WriteBufferSize,
+		maxIdle:          cfg.MaxIdleConns,
+		maxIdlePerHost:   cfg.MaxIdleConnsPerHost,
+		maxPerHost:       cfg.MaxConnsPerHost,
+		skipHostname:     cfg.SkipHostnameVerification,
+		http2:            cfg.http2Config(),
+		observers:        obs,
+		conns:            conns,
+		bytes:            counts,
+		latency:          latency,
+		order:            order,
+		headers:          headers,
+		handler:          swappable,
+		name:             cfg.Name,
+		shutdownObserver: cfg.ShutdownObserver,
+		shuttingDown:     shuttingDown,
+		hooksDone:        make(chan struct{}),
+		listeners:        listeners,
+		clock:            cfg.Clock,
+	}
+	// Like net/http's own shutdown hooks, ordered hooks run once the
+	// listeners have closed.
+	server.RegisterOnShutdown(func() {
+		srv.hooksOnce.Do(srv.runOrderedHooks)
+	})
+	if !cfg.ManualStart {
+		srv.startOnce.Do(srv.serve)
+	}
+	return srv, nil
+}
+
+// Start begins serving requests on a server constructed WithManualStart. It
+// returns an error if the server has already started. Servers constructed
+// without WithManualStart start automatically.
+func (s *Server) Start() error {
+	started := false
+	s.startOnce.Do(func() {
+		s.serve()
+		started = true
+	})
+	if !started {
+		return errors.New("memhttp: server already started")
+	}
+	return nil
+}
+
+// serve starts serving on all the server's listeners. It must be called
+// exactly once, via startOnce.
+func (s *Server) serve() {
+	go func() {
+		errs := make(chan error, len(s.listeners))
+		for _, l := range s.listeners {
+			go func(l net.Listener) {
+				errs <- s.server.Serve(l)
+			}(l)
+		}
+		var first error
+		for range s.listeners {
+			if err := <-errs; first == nil || errors.Is(first, http.ErrServerClosed) {
+				first = err
+			}
+		}
+		s.serveErr = first
+		close(s.serveDone)
+	}()
 }
 
 // Transport returns an [http.Transport] configured to use in-memory pipes
 // rather than TCP, disable automatic compression, trust the server's TLS
-// certificate (if any), and use HTTP/2 (if the server supports it).
+// certificate (if any), and use HTTP/2 (if the server supports it). The
+// transport validates certificates using the server's Clock.
 //
 // Callers may reconfigure the returned Transport without affecting other
 // transports or clients.
 func (s *Server) Transport() *http.Transport {
 	transport := &http.Transport{
-		DialContext:        s.listener.DialContext,
-		DisableCompression: true,
+		DialContext:         s.dialContext,
+		DisableCompression:  true,
+		ReadBufferSize:      s.readBuffer,
+		WriteBufferSize:     s.writeBuffer,
+		MaxIdleConns:        s.maxIdle,
+		MaxIdleConnsPerHost: s.maxIdlePerHost,
+		MaxConnsPerHost:     s.maxPerHost,
+		HTTP2:               s.http2,
 	}
 	if s.certificate != nil {
 		pool := x509.NewCertPool()
 		pool.AddCert(s.certificate)
-		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			ServerName: s.serverName,
+			Time:       s.clock.Now,
+		}
+		if s.skipHostname {
+			skipHostnameVerification(transport.TLSClientConfig)
+		}
 		transport.ForceAttemptHTTP2 = !s.disableHTTP2
 	}
+	if s.h2c {
+		// Use HTTP/2 with prior knowledge.
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
 	return transport
 }
 
+// verifiableName returns a name that clients can use to verify cert, or an
+// empty string if cert covers the server's synthetic hostname.
+func verifiableName(cert *x509.Certificate, host string) string {
+	switch {
+	case cert.VerifyHostname(host) == nil:
+		return ""
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	default:
+		return ""
+	}
+}
+
+// mergeTLSConfig returns a copy of custom, with fields it leaves unset filled
+// in from the server's defaults. The defaults' VerifyConnection always runs,
+// before custom's.
+func mergeTLSConfig(custom, defaults *tls.Config) *tls.Config {
+	merged := custom.Clone()
+	if len(merged.Certificates) == 0 && merged.GetCertificate == nil && merged.GetConfigForClient == nil {
+		merged.Certificates = defaults.Certificates
+	}
+	if len(merged.NextProtos) == 0 {
+		merged.NextProtos = defaults.NextProtos
+	}
+	if merged.CipherSuites == nil {
+		merged.CipherSuites = defaults.CipherSuites
+	}
+	if merged.ClientCAs == nil && merged.ClientAuth == tls.NoClientCert {
+		merged.ClientCAs, merged.ClientAuth = defaults.ClientCAs, defaults.ClientAuth
+	}
+	merged.VerifyConnection = defaults.VerifyConnection
+	if verify := custom.VerifyConnection; verify != nil {
+		merged.VerifyConnection = func(state tls.ConnectionState) error {
+			if err := defaults.VerifyConnection(state); err != nil {
+				return err
+			}
+			return verify(state)
+		}
+	}
+	return merged
+}
+
+// skipHostnameVerification makes cfg verify the server's certificate chain
+// against cfg.RootCAs, but not the server's hostname. Changes to cfg.RootCAs
+// and cfg.Time made after the call take effect.
+func skipHostnameVerification(cfg *tls.Config) {
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("tls: server didn't present a certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		if cfg.Time != nil {
+			opts.CurrentTime = cfg.Time()
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
 // Client returns an [http.Client] configured to use in-memory pipes rather
 // than TCP, disable automatic compression, trust the server's TLS certificate
 // (if any), and use HTTP/2 (if the server supports it).
@@ -111,29 +458,208 @@ func (s *Server) Client() *http.Client {
 	return &http.Client{Transport: s.Transport()}
 }
 
+// TLSDial dials the server and performs a TLS handshake without sending any
+// HTTP requests, so tests can inspect the negotiated protocol, version, and
+// certificates. If cfg is nil, TLSDial uses the same configuration as the
+// server's transports, offering HTTP/2 (if the server supports it) and
+// HTTP/1.1 via ALPN. Otherwise, TLSDial uses cfg as-is, except that it fills
+// in ServerName if cfg doesn't set it.
+//
+// TLSDial returns an error if the server was constructed WithoutTLS. Callers
+// must close the returned connection.
+func (s *Server) TLSDial(ctx context.Context, cfg *tls.Config) (*tls.Conn, error) {
+	if s.certificate == nil {
+		return nil, errors.New("memhttp: server doesn't use TLS")
+	}
+	if cfg == nil {
+		cfg = s.Transport().TLSClientConfig
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+		if s.disableHTTP2 {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = s.serverName
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = s.listener.Addr().String()
+	}
+	conn, err := s.listener.DialContext(ctx, "tcp", s.listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// SingleConnClient returns a client like Client, except that it sends all
+// requests over a single connection (see [http.Transport.MaxConnsPerHost]).
+// Over HTTP/1.1, concurrent requests wait for the connection to become idle,
+// which makes head-of-line blocking easy to reproduce.
+func (s *Server) SingleConnClient() *http.Client {
+	transport := s.Transport()
+	transport.MaxConnsPerHost = 1
+	transport.MaxIdleConnsPerHost = 1
+	return &http.Client{Transport: transport}
+}
+
+// Clients returns n independent clients, each with its own transport and
+// cookie jar, so that tests can simulate several users whose sessions don't
+// interfere. Like Client, each is configured to use in-memory pipes and trust
+// the server's TLS certificate (if any). To present a distinct client
+// certificate for each user, set the Certificates of each transport's
+// TLSClientConfig.
+func (s *Server) Clients(n int) []*http.Client {
+	clients := make([]*http.Client, n)
+	for i := range clients {
+		jar, _ := cookiejar.New(nil) // never returns an error
+		clients[i] = &http.Client{Transport: s.Transport(), Jar: jar}
+	}
+	return clients
+}
+
+// ClientWithCertificate returns a client like Client, except that it presents
+// cert during TLS handshakes. It's most useful with servers constructed
+// WithClientCA.
+func (s *Server) ClientWithCertificate(cert tls.Certificate) *http.Client {
+	transport := s.Transport()
+	if transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: transport}
+}
+
 // URL returns the server's URL.
 func (s *Server) URL() string {
 	return s.url
 }
 
+// Addr returns the address of the server's listener. It's the host in URL.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// PlaintextURL returns the URL of the server's plaintext HTTP listener. If the
+// server was constructed WithoutTLS, it's the same as URL. If the server uses
+// TLS and wasn't constructed WithPlaintextListener, PlaintextURL returns an
+// empty string.
+func (s *Server) PlaintextURL() string {
+	if s.certificate == nil {
+		return s.url
+	}
+	if s.plaintext == nil {
+		return ""
+	}
+	return "http://" + s.plaintext.Addr().String()
+}
+
+// Name returns the name set with WithName, if any.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// SwapHandler atomically replaces the server's handler, returning the handler
+// it replaced. Requests already in flight finish with the handler they
+// started with, and every later request uses h. Middleware configured with
+// options, like WithRequestTimeout, continues to wrap the new handler.
+func (s *Server) SwapHandler(h http.Handler) (previous http.Handler) {
+	return s.handler.swap(h)
+}
+
 // Close immediately shuts down the server. To shut down the server without
 // interrupting in-flight requests, use Shutdown.
 func (s *Server) Close() error {
-	if err := s.server.Close(); err != nil {
+	s.beginShutdown()
+	s.startOnce.Do(s.serve) // so that an unstarted server's listeners close
+	phases := s.observeShutdown(false /* graceful */)
+	err := s.server.Close()
+	phases.finish(false /* ok */)
+	if err != nil {
 		return err
 	}
 	return s.listenErr()
 }
 
 // Shutdown gracefully shuts down the server, without interrupting any active
-// connections. See [http.Server.Shutdown] for details.
+// connections. See [http.Server.Shutdown] for details. Long-running handlers
+// can use ShuttingDown to learn that shutdown has begun. If ctx ends before
+// shutdown completes, Shutdown returns a *ShutdownError listing the requests
+// still in flight.
 func (s *Server) Shutdown(ctx context.Context) error {
-	if err := s.server.Shutdown(ctx); err != nil {
-		return err
+	s.beginShutdown()
+	s.startOnce.Do(s.serve) // so that an unstarted server's listeners close
+	phases := s.observeShutdown(true /* graceful */)
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		select {
+		case <-s.hooksDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		inFlight := s.conns.active()
+		phases.finish(false /* ok */)
+		return &ShutdownError{Err: err, InFlight: inFlight}
 	}
+	phases.finish(true /* ok */)
 	return s.listenErr()
 }
 
+// ShutdownWithProgress is like Shutdown, but it also reports the number of
+// requests still in flight as shutdown progresses. It calls onProgress on the
+// calling goroutine, once at the start of shutdown and then whenever the
+// number of requests changes, until shutdown completes or ctx ends. Changes
+// that happen while onProgress is running are reported together. If shutdown
+// completes, the last call reports zero.
+func (s *Server) ShutdownWithProgress(ctx context.Context, onProgress func(remaining int)) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+	last := -1
+	for {
+		n, changed := s.conns.watchInFlight()
+		if n != last {
+			last = n
+			onProgress(n)
+		}
+		select {
+		case err := <-done:
+			if n, _ := s.conns.watchInFlight(); err == nil && n != last {
+				onProgress(n)
+			}
+			return err
+		case <-changed:
+		}
+	}
+}
+
+type shuttingDownKey struct{}
+
+// ShuttingDown returns a channel that's closed when the server handling a
+// request begins to shut down, via either Close or Shutdown. It's useful in
+// long-polling and streaming handlers, which should return promptly so that
+// shutdown can complete. Handlers should call it with the request's context.
+// If ctx doesn't come from a request handled by a memhttp server, ShuttingDown
+// returns nil.
+func ShuttingDown(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(shuttingDownKey{}).(chan struct{})
+	return ch
+}
+
+func (s *Server) beginShutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shuttingDown)
+	})
+}
+
 // Cleanup calls Shutdown with a five second timeout. To customize the timeout,
 // use WithCleanupTimeout.
 //
@@ -152,52 +678,282 @@ func (s *Server) RegisterOnShutdown(f func()) {
 	s.server.RegisterOnShutdown(f)
 }
 
+// RegisterOnShutdownOrdered registers a function to call on Shutdown. Unlike
+// hooks registered with RegisterOnShutdown, which net/http runs concurrently,
+// ordered hooks run one at a time in the order they were registered. Like
+// hooks registered with RegisterOnShutdown, they start once the server has
+// stopped accepting connections, while in-flight requests drain. They all
+// return before Shutdown does, unless Shutdown's context ends first. Close
+// doesn't run ordered hooks.
+func (s *Server) RegisterOnShutdownOrdered(f func()) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.orderedHooks = append(s.orderedHooks, f)
+}
+
+func (s *Server) runOrderedHooks() {
+	s.hooksMu.Lock()
+	hooks := s.orderedHooks
+	s.hooksMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	close(s.hooksDone)
+}
+
+// ServeConn serves HTTP on an externally-created connection, as if it had been
+// dialed with the server's transport. It's useful when integrating memhttp
+// with other in-memory transports. Unless the server was constructed
+// WithoutTLS, the peer must perform a TLS handshake.
+//
+// ServeConn doesn't block. If the server closes before accepting the
+// connection, ServeConn closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	go s.listener.enqueue(conn)
+}
+
+// dialContext dials the plaintext listener for port 80, if there is one, and
+// the main listener otherwise.
+func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.listenerFor(addr).DialContext(ctx, network, addr)
+}
+
+func (s *Server) listenerFor(addr string) *memoryListener {
+	if _, port, err := net.SplitHostPort(addr); err == nil && port == "80" && s.plaintext != nil {
+		return s.plaintext
+	}
+	return s.listener
+}
+
+// Pause simulates a stalled server by no longer accepting new connections.
+// Once the accept backlog (see WithAcceptBacklog) is full, dials block until
+// the server resumes, closes, or the dial's context ends; by default, there's
+// no backlog. Connections in the backlog aren't served until the server
+// resumes. Existing connections aren't affected.
+func (s *Server) Pause() {
+	s.listener.setPaused(true)
+	if s.plaintext != nil {
+		s.plaintext.setPaused(true)
+	}
+}
+
+// Resume undoes Pause, so that the server accepts new connections again.
+func (s *Server) Resume() {
+	s.listener.setPaused(false)
+	if s.plaintext != nil {
+		s.plaintext.setPaused(false)
+	}
+}
+
+// ServeError reports why the server stopped serving. It returns nil if the
+// server is still running or was stopped by Close or Shutdown. Unlike Close
+// and Shutdown, ServeError never stops the server, so it's safe to call at any
+// time to check for failures. If the server was constructed WithStrictTLS, it
+// also reports the first failed TLS handshake.
+func (s *Server) ServeError() error {
+	select {
+	case <-s.serveDone:
+		return s.serveResult()
+	default:
+		return s.conns.handshakeError()
+	}
+}
+
+// Closed reports whether the server's listener has closed, which happens as
+// soon as Close or Shutdown is called. It doesn't dial the server or wait for
+// in-flight requests.
+func (s *Server) Closed() bool {
+	return isClosed(s.listener.closed)
+}
+
 func (s *Server) listenErr() error {
-	if err := <-s.serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+	<-s.serveDone
+	return s.serveResult()
+}
+
+func (s *Server) serveResult() error {
+	if err := s.serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
-	return nil
+	return s.conns.handshakeError()
 }
 
+// errListenerClosed is returned by Accept and DialContext once the listener
+// has closed. It wraps net.ErrClosed, which is how callers (including
+// net/http) recognize a normal shutdown.
+var errListenerClosed = fmt.Errorf("listener closed: %w", net.ErrClosed)
+
+// memoryListener is a net.Listener backed by in-memory pipes.
+//
+// Accept runs on the http.Server's single serve goroutine, so it does little
+// but receive connections from a channel (unless the listener is paused);
+// net/http then serves each connection on its own goroutine. Any
+// per-connection setup (creating pipes, wrapping connections, recording
+// metrics) belongs on the dialing goroutine, in DialContext or enqueue, so
+// that concurrent dials never serialize behind one another.
 type memoryListener struct {
-	conns  chan net.Conn
-	once   sync.Once
-	closed chan struct{}
+	conns       chan net.Conn // buffered to the accept backlog
+	once        sync.Once
+	closed      chan struct{}
+	clock       Clock
+	dialTimeout time.Duration // zero means no timeout
+	pipe        pipeConfig    // for dialed conns
+	acceptErr   error         // injected by WithServeError
+
+	mu      sync.Mutex
+	paused  bool
+	changed chan struct{} // closed and replaced when paused changes
+}
+
+func newMemoryListener(cfg *config) *memoryListener {
+	return &memoryListener{
+		conns:       make(chan net.Conn, cfg.AcceptBacklog),
+		closed:      make(chan struct{}),
+		clock:       cfg.Clock,
+		dialTimeout: cfg.DialTimeout,
+		pipe: pipeConfig{
+			maxRead:     cfg.MaxReadChunk,
+			idleTimeout: cfg.ConnIdleTimeout,
+			bufferSize:  cfg.ConnBufferSize,
+			latency:     cfg.Latency,
+			bandwidth:   cfg.Bandwidth,
+		},
+		acceptErr: cfg.ServeError,
+		changed:   make(chan struct{}),
+	}
+}
+
+// setPaused controls whether Accept waits for connections.
+func (l *memoryListener) setPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused != paused {
+		l.paused = paused
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
 }
 
 // Accept implements net.Listener.
 func (l *memoryListener) Accept() (net.Conn, error) {
-	select {
-	case conn := <-l.conns:
-		return conn, nil
-	case <-l.closed:
-		return nil, errors.New("listener closed")
+	if l.acceptErr != nil {
+		return nil, l.acceptErr
+	}
+	for {
+		l.mu.Lock()
+		paused, changed := l.paused, l.changed
+		l.mu.Unlock()
+		var conns chan net.Conn
+		if !paused {
+			conns = l.conns
+		}
+		select {
+		case conn := <-conns:
+			return conn, nil
+		case <-changed:
+		case <-l.closed:
+			return nil, &net.OpError{Op: "accept", Net: "memory", Addr: l.Addr(), Err: errListenerClosed}
+		}
 	}
 }
 
-// Close implements net.Listener.
+// Close implements net.Listener. It closes any connections waiting in the
+// backlog.
 func (l *memoryListener) Close() error {
 	l.once.Do(func() {
 		close(l.closed)
 	})
+	l.drain()
 	return nil
 }
 
+// drain closes connections waiting in the backlog.
+func (l *memoryListener) drain() {
+	for {
+		select {
+		case conn := <-l.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
 // Addr implements net.Listener.
 func (l *memoryListener) Addr() net.Addr {
 	return &memoryAddr{}
 }
 
-// DialContext is the type expected by http.Transport.DialContext.
+// DialContext is the type expected by http.Transport.DialContext. It refuses
+// to dial hosts other than the listener's own, so that clients following
+// redirects to other hosts fail clearly rather than silently reaching this
+// server. Like Resolver, it reports other hosts as not found with a
+// *net.OpError wrapping a *net.DNSError.
 func (l *memoryListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if want := l.Addr().String(); host != want {
+		// Fail like a DNS lookup for a nonexistent host, as Resolver does.
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: &net.DNSError{
+				Err:        "memhttp server only serves " + want,
+				Name:       host,
+				IsNotFound: true,
+			},
+		}
+	}
 	select {
 	case <-l.closed:
-		return nil, errors.New("listener closed")
+		return nil, fmt.Errorf("dial %s: %w", addr, errListenerClosed)
 	default:
 	}
-	server, client := net.Pipe()
-	l.conns <- server
-	return client, nil
+	// If there's room in the backlog, the send below may win even if ctx has
+	// already ended.
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	server, client := newPipe(l.clock, l.pipe)
+	var timeout <-chan time.Time // nil channels block forever
+	if l.dialTimeout > 0 {
+		timeout = l.clock.After(l.dialTimeout)
+	}
+	select {
+	case l.conns <- server:
+		// If the listener closed concurrently, don't strand the connection in
+		// the backlog.
+		if isClosed(l.closed) {
+			l.drain()
+		}
+		return client, nil
+	case <-l.closed:
+		server.Close()
+		client.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, errListenerClosed)
+	case <-ctx.Done():
+		server.Close()
+		client.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, ctx.Err())
+	case <-timeout:
+		server.Close()
+		client.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+}
+
+// enqueue hands conn to Accept, closing it if the listener closes first.
+func (l *memoryListener) enqueue(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+		if isClosed(l.closed) {
+			l.drain()
+		}
+	case <-l.closed:
+		conn.Close()
+	}
 }
 
 type memoryAddr struct{}
@@ -0,0 +1,168 @@
+package memhttp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"go.akshayshah.org/memhttp"
+	"go.akshayshah.org/memhttp/memhttptest"
+)
+
+func BenchmarkTransportBufferSizes(b *testing.B) {
+	const size = 1 << 20
+	payload := bytes.Repeat([]byte{'a'}, size)
+	download := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	for _, bufSize := range []int{4 * 1024, 32 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", bufSize/1024), func(b *testing.B) {
+			srv := memhttptest.New(
+				b,
+				download,
+				memhttp.WithoutHTTP2(),
+				memhttp.WithTransportBufferSizes(bufSize, bufSize),
+			)
+			client := srv.Client()
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := client.Get(srv.URL())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, res.Body); err != nil {
+					b.Fatal(err)
+				}
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkConnectionBuffer(b *testing.B) {
+	const size = 1 << 20
+	payload := bytes.Repeat([]byte{'a'}, size)
+	download := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	for _, bufSize := range []int{0, 64 * 1024, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", bufSize/1024), func(b *testing.B) {
+			srv := memhttptest.NewBenchmark(b, download, memhttp.WithConnectionBuffer(bufSize))
+			client := srv.Client()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				res, err := client.Get(srv.URL())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, res.Body); err != nil {
+					b.Fatal(err)
+				}
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentDials(b *testing.B) {
+	srv := memhttptest.New(b, &greeter{}, memhttp.WithoutTLS())
+	dial := srv.Transport().DialContext
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := dial(context.Background(), "tcp", "example.com:80")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			conn.Close()
+		}
+	})
+}
+
+var benchProtocols = []struct {
+	name string
+	opts []memhttp.Option
+}{
+	{"http2", nil},
+	{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
+	{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}},
+}
+
+func BenchmarkSmallGet(b *testing.B) {
+	for _, p := range benchProtocols {
+		b.Run(p.name, func(b *testing.B) {
+			srv := memhttptest.NewBenchmark(b, &greeter{}, p.opts...)
+			client := srv.Client()
+			for i := 0; i < b.N; i++ {
+				benchGet(b, client, srv.URL())
+			}
+		})
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	const size = 4 << 20
+	payload := bytes.Repeat([]byte{'a'}, size)
+	download := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	for _, p := range benchProtocols {
+		b.Run(p.name, func(b *testing.B) {
+			srv := memhttptest.NewBenchmark(b, download, p.opts...)
+			client := srv.Client()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				benchGet(b, client, srv.URL())
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentConnections(b *testing.B) {
+	for _, p := range benchProtocols {
+		b.Run(p.name, func(b *testing.B) {
+			srv := memhttptest.NewBenchmark(b, &greeter{}, p.opts...)
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine has its own client, and so its own connection.
+				client := srv.Client()
+				defer client.CloseIdleConnections()
+				for pb.Next() {
+					benchGet(b, client, srv.URL())
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkNoKeepAlive(b *testing.B) {
+	for _, p := range benchProtocols {
+		b.Run(p.name, func(b *testing.B) {
+			srv := memhttptest.NewBenchmark(b, &greeter{}, p.opts...)
+			transport := srv.Transport()
+			transport.DisableKeepAlives = true
+			client := &http.Client{Transport: transport}
+			for i := 0; i < b.N; i++ {
+				benchGet(b, client, srv.URL())
+			}
+		})
+	}
+}
+
+func benchGet(b *testing.B, client *http.Client, url string) {
+	res, err := client.Get(url)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		b.Error(err)
+	}
+	res.Body.Close()
+}
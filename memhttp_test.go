@@ -1,12 +1,26 @@
 package memhttp_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,63 +39,3080 @@ func (h *greeter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func TestServer(t *testing.T) {
 	t.Parallel()
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			const concurrency = 100
+			srv := memhttptest.New(t, &greeter{}, tt.opts...)
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client := srv.Client()
+					req, err := http.NewRequestWithContext(
+						context.Background(),
+						http.MethodGet,
+						srv.URL(),
+						strings.NewReader(""),
+					)
+					attest.Ok(t, err)
+					<-start
+					res, err := client.Do(req)
+					attest.Ok(t, err)
+					attest.Equal(t, res.StatusCode, http.StatusOK, attest.Continue())
+					body, err := io.ReadAll(res.Body)
+					attest.Ok(t, err)
+					attest.Equal(t, string(body), greeting)
+				}()
+			}
+			close(start)
+			wg.Wait()
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.New(&greeter{})
+	attest.Ok(t, err)
+	attest.False(t, srv.Closed())
+	attest.Ok(t, srv.Close())
+	attest.True(t, srv.Closed())
+}
+
+func TestActiveRequests(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithClock(clock))
+	attest.Zero(t, len(srv.ActiveRequests()))
+	start := clock.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := srv.Client().Get(srv.URL() + "/slow?q=1")
+		if attest.Ok(t, err) {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	clock.Advance(time.Second)
+	active := srv.ActiveRequests()
+	attest.Equal(t, active, []memhttp.InFlightRequest{{
+		Method:  http.MethodGet,
+		URL:     "example.com/slow?q=1",
+		Path:    "/slow",
+		Proto:   "HTTP/2.0",
+		Started: start,
+		Elapsed: time.Second,
+	}})
+	clock.Advance(time.Second)
+	attest.Equal(t, srv.ActiveRequests()[0].Elapsed, 2*time.Second)
+	close(release)
+	<-done
+	attest.Zero(t, len(srv.ActiveRequests()))
+}
+
+func TestInjectedServeError(t *testing.T) {
+	t.Parallel()
+	injected := errors.New("injected serve failure")
+	for _, opts := range [][]memhttp.Option{nil, {memhttp.WithPlaintextListener()}} {
+		srv, err := memhttp.New(&greeter{}, append(opts, memhttp.WithServeError(injected))...)
+		attest.Ok(t, err)
+		deadline := time.Now().Add(5 * time.Second)
+		for srv.ServeError() == nil && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		attest.ErrorIs(t, srv.ServeError(), injected)
+		_, err = srv.Client().Get(srv.URL())
+		attest.Error(t, err)
+		attest.ErrorIs(t, srv.Close(), injected)
+		attest.ErrorIs(t, srv.Shutdown(context.Background()), injected)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	t.Parallel()
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			started := make(chan struct{})
+			cancelled := make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-r.Context().Done()
+				close(cancelled)
+			})
+			srv := memhttptest.New(t, handler, tt.opts...)
+			transport := srv.Transport()
+			conns := make(chan net.Conn, 1)
+			dial := transport.DialContext
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err == nil {
+					conns <- conn
+				}
+				return conn, err
+			}
+			go func() {
+				res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+				if err == nil {
+					res.Body.Close()
+				}
+			}()
+			<-started
+			// Abruptly close the client's end of the connection, without
+			// cancelling the request.
+			(<-conns).Close()
+			select {
+			case <-cancelled:
+			case <-time.After(time.Second):
+				t.Fatal("handler's context wasn't cancelled after client disconnected")
+			}
+		})
+	}
+}
+
+func TestCompatServer(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.NewCompat(&greeter{})
+	attest.Ok(t, err, attest.Fatal())
+	// The rest of the test is written for *httptest.Server.
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL + "/hello")
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), greeting)
+	attest.Ok(t, srv.Certificate().VerifyHostname("example.com"))
+}
+
+func TestShutdownWithProgress(t *testing.T) {
+	t.Parallel()
+	const requests = 3
+	var started sync.WaitGroup
+	started.Add(requests)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	})
+	srv, err := memhttp.New(handler)
+	attest.Ok(t, err)
+	client := srv.Client()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(srv.URL())
+			if attest.Ok(t, err) {
+				res.Body.Close()
+			}
+		}()
+	}
+	started.Wait()
+	var progress []int
+	err = srv.ShutdownWithProgress(context.Background(), func(remaining int) {
+		progress = append(progress, remaining)
+		if remaining > 0 {
+			// Finish one request at a time, so each change is reported.
+			release <- struct{}{}
+		}
+	})
+	attest.Ok(t, err)
+	wg.Wait()
+	attest.Equal(t, progress, []int{3, 2, 1, 0})
+}
+
+func TestCancelCause(t *testing.T) {
+	t.Parallel()
+	causes := make(chan error, 1)
+	started := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	})
+	// send starts a request and, once the handler is running, calls
+	// interrupt.
+	send := func(t *testing.T, srv *memhttp.Server, interrupt func(cancel context.CancelFunc, conn net.Conn)) {
+		transport := srv.Transport()
+		conns := make(chan net.Conn, 1)
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL(), nil)
+		attest.Ok(t, err, attest.Fatal())
+		errs := make(chan error, 1)
+		go func() {
+			_, err := (&http.Client{Transport: transport}).Do(req)
+			errs <- err
+		}()
+		<-started
+		interrupt(cancel, <-conns)
+		attest.Error(t, <-errs)
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		srv := memhttptest.New(t, handler)
+		send(t, srv, func(cancel context.CancelFunc, _ net.Conn) { cancel() })
+		attest.ErrorIs(t, <-causes, memhttp.ErrRequestCanceled)
+	})
+	t.Run("cancel_http1", func(t *testing.T) {
+		srv := memhttptest.New(t, handler, memhttp.WithoutHTTP2())
+		send(t, srv, func(cancel context.CancelFunc, _ net.Conn) { cancel() })
+		attest.ErrorIs(t, <-causes, memhttp.ErrConnClosed)
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		srv := memhttptest.New(t, handler)
+		send(t, srv, func(_ context.CancelFunc, conn net.Conn) { conn.Close() })
+		attest.ErrorIs(t, <-causes, memhttp.ErrConnClosed)
+	})
+}
+
+func TestLatencyStats(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.URL.Query().Get("ms"))
+		attest.Ok(t, err)
+		clock.Advance(time.Duration(ms) * time.Millisecond)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithClock(clock))
+	attest.Zero(t, srv.LatencyStats())
+	for ms := 1; ms <= 100; ms++ {
+		res, err := srv.Client().Get(fmt.Sprintf("%s?ms=%d", srv.URL(), ms))
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+	}
+	stats := srv.LatencyStats()
+	attest.Equal(t, stats.Count, int64(100))
+	attest.Equal(t, stats.Min, time.Millisecond)
+	attest.Equal(t, stats.Max, 100*time.Millisecond)
+	for _, tt := range []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"p50", stats.P50, 50 * time.Millisecond},
+		{"p90", stats.P90, 90 * time.Millisecond},
+		{"p99", stats.P99, 99 * time.Millisecond},
+	} {
+		// Buckets are about 9% wide.
+		attest.True(t, tt.got >= tt.want && tt.got <= tt.want*110/100, attest.Sprintf("%s = %v, want about %v", tt.name, tt.got, tt.want))
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	t.Parallel()
+	const delay = 10 * time.Second
+	get := func(t *testing.T, srv *memhttp.Server) *http.Response {
+		t.Helper()
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		return res
+	}
+	t.Run("unavailable", func(t *testing.T) {
+		t.Parallel()
+		clock := newFakeClock()
+		srv := memhttptest.New(t, &greeter{}, memhttp.WithClock(clock), memhttp.WithStartupDelay(delay, false))
+		res := get(t, srv)
+		attest.Equal(t, res.StatusCode, http.StatusServiceUnavailable)
+		attest.Equal(t, res.Header.Get("Retry-After"), "10")
+		clock.Advance(delay)
+		attest.Equal(t, get(t, srv).StatusCode, http.StatusOK)
+	})
+	t.Run("block", func(t *testing.T) {
+		t.Parallel()
+		clock := newFakeClock()
+		srv := memhttptest.New(t, &greeter{}, memhttp.WithClock(clock), memhttp.WithStartupDelay(delay, true))
+		codes := make(chan int, 1)
+		go func() {
+			res, err := srv.Client().Get(srv.URL())
+			if !attest.Ok(t, err) {
+				codes <- 0
+				return
+			}
+			res.Body.Close()
+			codes <- res.StatusCode
+		}()
+		select {
+		case code := <-codes:
+			t.Fatalf("request finished during startup with status %d", code)
+		case <-time.After(20 * time.Millisecond):
+		}
+		clock.Advance(delay)
+		attest.Equal(t, <-codes, http.StatusOK)
+	})
+}
+
+func TestServerTiming(t *testing.T) {
+	t.Parallel()
+	const delay = 20 * time.Millisecond
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.URL.Path == "/write" {
+			io.WriteString(w, greeting)
+		}
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithServerTiming())
+	for _, path := range []string{"/write", "/empty"} {
+		res, err := srv.Client().Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		var ms float64
+		_, err = fmt.Sscanf(res.Header.Get("Server-Timing"), "handler;dur=%g", &ms)
+		attest.Ok(t, err, attest.Sprintf("Server-Timing: %q", res.Header.Get("Server-Timing")))
+		dur := time.Duration(ms * float64(time.Millisecond))
+		attest.True(t, dur >= delay && dur < delay+5*time.Second, attest.Sprintf("%s reported %v", path, dur))
+	}
+}
+
+func TestSwapHandler(t *testing.T) {
+	t.Parallel()
+	version := func(v int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			io.WriteString(w, strconv.Itoa(v))
+		})
+	}
+	const versions = 20
+	srv := memhttptest.New(t, version(0))
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				res, err := srv.Client().Get(srv.URL())
+				if !attest.Ok(t, err) {
+					return
+				}
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				attest.Ok(t, err)
+				v, err := strconv.Atoi(string(body))
+				attest.Ok(t, err, attest.Sprintf("body %q", body))
+				attest.True(t, v >= 0 && v < versions, attest.Sprintf("version %d", v))
+			}
+		}()
+	}
+	for v := 1; v < versions; v++ {
+		time.Sleep(time.Millisecond)
+		prev := srv.SwapHandler(version(v))
+		rec := httptest.NewRecorder()
+		prev.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		attest.Equal(t, rec.Body.String(), strconv.Itoa(v-1))
+	}
+	close(stop)
+	wg.Wait()
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), strconv.Itoa(versions-1))
+}
+
+func TestShutdownObserver(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, greeting)
+	})
+	var phases []string
+	srv, err := memhttp.New(handler, memhttp.WithShutdownObserver(func(phase string) {
+		phases = append(phases, phase)
+		if phase == memhttp.ShutdownDraining {
+			close(release)
+		}
+	}))
+	attest.Ok(t, err, attest.Fatal())
+	errs := make(chan error, 1)
+	go func() {
+		res, err := srv.Client().Get(srv.URL())
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		errs <- err
+	}()
+	<-started
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	attest.Ok(t, <-errs)
+	attest.Equal(t, phases, []string{
+		memhttp.ShutdownStoppedAccepting,
+		memhttp.ShutdownDraining,
+		memhttp.ShutdownClosingIdle,
+		memhttp.ShutdownDone,
+	})
+
+	phases = nil
+	srv, err = memhttp.New(&greeter{}, memhttp.WithShutdownObserver(func(phase string) {
+		phases = append(phases, phase)
+	}))
+	attest.Ok(t, err, attest.Fatal())
+	attest.Ok(t, srv.Close())
+	attest.Equal(t, phases, []string{memhttp.ShutdownStoppedAccepting, memhttp.ShutdownDone})
+}
+
+func TestRegisterOnShutdown(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.New(&greeter{})
+	attest.Ok(t, err)
+	done := make(chan struct{})
+	srv.RegisterOnShutdown(func() {
+		close(done)
+	})
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("OnShutdown hook didn't fire")
+	}
+}
+
+func TestRegisterOnShutdownOrdered(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.New(&greeter{})
+	attest.Ok(t, err)
+	var fired []int
+	for i := 0; i < 5; i++ {
+		srv.RegisterOnShutdownOrdered(func() {
+			time.Sleep(time.Duration(5-i) * time.Millisecond)
+			fired = append(fired, i)
+		})
+	}
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	attest.Equal(t, fired, []int{0, 1, 2, 3, 4})
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	attest.Equal(t, len(fired), 5, attest.Sprintf("hooks should run once"))
+}
+
+func TestOnRequestOrder(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	var order []int
+	unregister := make([]func(), 5)
+	for i := range unregister {
+		unregister[i] = srv.OnRequest(func(*http.Request) { order = append(order, i) })
+	}
+	get := func() {
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+	}
+	get()
+	attest.Equal(t, order, []int{0, 1, 2, 3, 4})
+	order = nil
+	unregister[2]()
+	get()
+	attest.Equal(t, order, []int{0, 1, 3, 4})
+
+	// Observers can unregister themselves.
+	var once atomic.Int64
+	var self func()
+	self = srv.OnRequest(func(*http.Request) {
+		once.Add(1)
+		self()
+	})
+	get()
+	get()
+	attest.Equal(t, once.Load(), int64(1))
+}
+
+func TestOrderedHooksAfterListenersClose(t *testing.T) {
+	t.Parallel()
+	var served atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	})
+	srv, err := memhttp.New(handler)
+	attest.Ok(t, err, attest.Fatal())
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	hookErrs := make(chan error, 1)
+	srv.RegisterOnShutdownOrdered(func() {
+		// Requests on new connections should fail once hooks run.
+		res, err := srv.Client().Get(srv.URL())
+		if err == nil {
+			res.Body.Close()
+		}
+		hookErrs <- err
+	})
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	attest.Error(t, <-hookErrs)
+	attest.Equal(t, served.Load(), int64(1))
+}
+
+func TestInvoke(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["x-lowercase"] = []string{"value"}
+		io.WriteString(w, r.Method+" "+r.Host+r.URL.Path)
+	})
+	srv := memhttptest.New(t, handler)
+	res, err := srv.Invoke(httptest.NewRequest(http.MethodPost, "/invoked", strings.NewReader("body")))
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, res.StatusCode, http.StatusOK)
+	attest.Equal(t, string(body), "POST example.com/invoked")
+	attest.Equal(t, res.Header.Get("X-Lowercase"), "value")
+	attest.Equal(t, res.Header.Get("Content-Type"), "text/plain; charset=utf-8")
+	attest.NotZero(t, res.Header.Get("Date"))
+	attest.Equal(t, res.Request.URL.String(), srv.URL()+"/invoked")
+}
+
+func TestClientWithHeaders(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, memhttptest.EchoHandler())
+	client := srv.ClientWithHeaders(http.Header{
+		"authorization": []string{"Bearer default"},
+		"X-Trace":       []string{"a", "b"},
+	})
+	echo := func(req *http.Request) memhttptest.Echo {
+		res, err := client.Do(req)
+		attest.Ok(t, err, attest.Fatal())
+		var echo memhttptest.Echo
+		memhttptest.DecodeJSON(t, res, &echo)
+		return echo
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err)
+	got := echo(req)
+	attest.Equal(t, got.Header.Get("Authorization"), "Bearer default")
+	attest.Equal(t, got.Header.Values("X-Trace"), []string{"a", "b"})
+	attest.Zero(t, req.Header.Get("Authorization")) // caller's request is unmodified
+
+	req, err = http.NewRequest(http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err)
+	req.Header.Set("Authorization", "Bearer explicit")
+	got = echo(req)
+	attest.Equal(t, got.Header.Get("Authorization"), "Bearer explicit")
+	attest.Equal(t, got.Header.Values("X-Trace"), []string{"a", "b"})
+}
+
+func TestClientWithRedirectTrace(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusFound))
+	mux.Handle("/b", http.RedirectHandler("/c?q=1", http.StatusFound))
+	mux.Handle("/c", &greeter{})
+	mux.Handle("/loop", http.RedirectHandler("/loop", http.StatusFound))
+	srv := memhttptest.New(t, mux)
+	client, trace := srv.ClientWithRedirectTrace()
+	attest.Zero(t, len(trace()))
+
+	res, err := client.Get(srv.URL() + "/a")
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.StatusCode, http.StatusOK)
+	var got []string
+	for _, u := range trace() {
+		got = append(got, u.String())
+	}
+	attest.Equal(t, got, []string{srv.URL() + "/a", srv.URL() + "/b", srv.URL() + "/c?q=1"})
+
+	_, err = client.Get(srv.URL() + "/loop")
+	attest.Error(t, err)
+	attest.Equal(t, len(trace()), 10) // the original request and 9 redirects
+}
+
+func TestClientWithMaxResponseBytes(t *testing.T) {
+	t.Parallel()
+	const limit = 10
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		attest.Ok(t, err)
+		w.Write(bytes.Repeat([]byte{'a'}, n))
+	})
+	srv := memhttptest.New(t, handler)
+	client := srv.ClientWithMaxResponseBytes(limit)
+	get := func(n int) ([]byte, error) {
+		res, err := client.Get(fmt.Sprintf("%s/?n=%d", srv.URL(), n))
+		attest.Ok(t, err, attest.Fatal())
+		defer func() { attest.Ok(t, res.Body.Close()) }()
+		return io.ReadAll(res.Body)
+	}
+
+	body, err := get(limit)
+	attest.Ok(t, err)
+	attest.Equal(t, len(body), limit)
+
+	body, err = get(1 << 20)
+	var maxErr *http.MaxBytesError
+	attest.True(t, errors.As(err, &maxErr), attest.Sprintf("got error %v", err))
+	attest.Equal(t, maxErr.Limit, limit)
+	attest.Equal(t, len(body), limit)
+}
+
+func TestClientWithInterceptor(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	const stubbed = "stubbed"
+	client := srv.ClientWithInterceptor(func(r *http.Request) (*http.Response, bool) {
+		switch r.URL.Path {
+		case "/stub":
+		case "/nil":
+			return nil, true
+		default:
+			return nil, false
+		}
+		return &http.Response{
+			StatusCode: http.StatusTeapot,
+			Body:       io.NopCloser(strings.NewReader(stubbed)),
+		}, true
+	})
+	get := func(path string) (int, string) {
+		t.Helper()
+		res, err := client.Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		return res.StatusCode, string(body)
+	}
+	code, body := get("/stub")
+	attest.Equal(t, code, http.StatusTeapot)
+	attest.Equal(t, body, stubbed)
+	code, body = get("/real")
+	attest.Equal(t, code, http.StatusOK)
+	attest.Equal(t, body, greeting)
+	_, err := client.Get(srv.URL() + "/nil")
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "interceptor returned nil response")
+}
+
+func TestHARCapture(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hints" {
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.Copy(w, r.Body)
+	})
+	srv := memhttptest.New(t, echo, memhttp.WithHARCapture(), memhttp.WithClock(clock))
+	res, err := srv.Client().Post(srv.URL()+"/echo?q=1", "text/plain", strings.NewReader(greeting))
+	attest.Ok(t, err, attest.Fatal())
+	_, err = io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	res.Body.Close()
+	res, err = srv.Client().Get(srv.URL() + "/hints")
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+
+	var buf bytes.Buffer
+	attest.Ok(t, srv.WriteHAR(&buf))
+	var har struct {
+		Log struct {
+			Version string
+			Entries []struct {
+				StartedDateTime time.Time
+				Request         struct {
+					Method   string
+					URL      string
+					PostData struct{ Text string }
+				}
+				Response struct {
+					Status  int
+					Content struct{ Text string }
+				}
+			}
+		}
+	}
+	attest.Ok(t, json.Unmarshal(buf.Bytes(), &har), attest.Fatal())
+	attest.Equal(t, har.Log.Version, "1.2")
+	attest.Equal(t, len(har.Log.Entries), 2, attest.Fatal())
+	entry := har.Log.Entries[0]
+	attest.Equal(t, entry.Request.Method, http.MethodPost)
+	attest.Equal(t, entry.Request.URL, srv.URL()+"/echo?q=1")
+	attest.Equal(t, entry.Request.PostData.Text, greeting)
+	attest.Equal(t, entry.Response.Status, http.StatusOK)
+	attest.Equal(t, entry.Response.Content.Text, greeting)
+	attest.True(t, entry.StartedDateTime.Equal(clock.Now()), attest.Sprintf("started at %v", entry.StartedDateTime))
+	// Informational responses aren't recorded as the final status.
+	attest.Equal(t, har.Log.Entries[1].Response.Status, http.StatusCreated)
+
+	// Only recent exchanges are retained.
+	for range 1000 {
+		res, err := srv.Client().Get(srv.URL() + "/hints")
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+	}
+	buf.Reset()
+	attest.Ok(t, srv.WriteHAR(&buf))
+	attest.Ok(t, json.Unmarshal(buf.Bytes(), &har), attest.Fatal())
+	attest.Equal(t, len(har.Log.Entries), 1000)
+	attest.Equal(t, har.Log.Entries[0].Request.Method, http.MethodGet)
+
+	plain := memhttptest.New(t, &greeter{})
+	attest.Error(t, plain.WriteHAR(io.Discard))
+}
+
+func TestClockWriteTimeout(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	release := make(chan struct{})
+	stall := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // never read the body
+	})
+	srv := memhttptest.New(t, stall, memhttp.WithoutTLS(), memhttp.WithClock(clock))
+	defer close(release)
+	conn, err := srv.Transport().DialContext(context.Background(), "tcp", "example.com:80")
+	attest.Ok(t, err, attest.Fatal())
+	defer conn.Close()
+	const size = 1 << 20
+	_, err = fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n", size)
+	attest.Ok(t, err, attest.Fatal())
+
+	attest.Ok(t, conn.SetWriteDeadline(clock.Now().Add(time.Minute)))
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, size))
+		done <- err
+	}()
+	clock.Advance(time.Hour)
+	select {
+	case err := <-done:
+		var netErr net.Error
+		attest.True(t, errors.As(err, &netErr), attest.Sprintf("unexpected error %v", err))
+		attest.True(t, netErr.Timeout())
+	case <-time.After(5 * time.Second):
+		t.Fatal("write didn't time out")
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	server, client := net.Pipe()
+	srv.ServeConn(server)
+	transport := srv.Transport()
+	var dialed bool
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dialed {
+			return nil, errors.New("already dialed")
+		}
+		dialed = true
+		return client, nil
+	}
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	attest.Equal(t, res.StatusCode, http.StatusOK)
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), greeting)
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+	const header = "X-Request-Id"
+	observed := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := memhttp.RequestIDFromContext(r.Context())
+		observed <- id
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithRequestID(header))
+	client := srv.Client()
+
+	res, err := client.Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	generated := res.Header.Get(header)
+	attest.NotZero(t, generated)
+	attest.Equal(t, <-observed, generated)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err)
+	req.Header.Set(header, "supplied")
+	res, err = client.Do(req)
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.Header.Get(header), "supplied")
+	attest.Equal(t, <-observed, "supplied")
+}
+
+func TestHandleOrder(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithRequestID("X-Request-Id"))
+	ids := []string{"c", "a", "d", "b"}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+		attest.Ok(t, err, attest.Fatal())
+		req.Header.Set("X-Request-Id", id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := srv.Client().Do(req)
+			attest.Ok(t, err)
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+		<-started // start handlers one at a time
+	}
+	close(release)
+	wg.Wait()
+	attest.Equal(t, srv.HandleOrder(), ids)
+	attest.Zero(t, memhttptest.New(t, handler).HandleOrder())
+
+	// Only recent IDs are retained.
+	bounded := memhttptest.New(t, &greeter{}, memhttp.WithRequestID("X-Request-Id"))
+	client := bounded.Client()
+	for i := range 1001 {
+		req, err := http.NewRequest(http.MethodGet, bounded.URL(), nil)
+		attest.Ok(t, err, attest.Fatal())
+		req.Header.Set("X-Request-Id", strconv.Itoa(i))
+		res, err := client.Do(req)
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+	}
+	order := bounded.HandleOrder()
+	attest.Equal(t, len(order), 1000)
+	attest.Equal(t, order[0], "1")
+	attest.Equal(t, order[len(order)-1], "1000")
+}
+
+func TestPathLatency(t *testing.T) {
+	t.Parallel()
+	const slow = 100 * time.Millisecond
+	var calls atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithPathLatency(map[string]time.Duration{
+		"/slow":      slow,
+		"/slow/fast": 0, // longest prefix wins
+	}))
+	elapsed := func(path string) time.Duration {
+		start := time.Now()
+		res, err := srv.Client().Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		return time.Since(start)
+	}
+	attest.True(t, elapsed("/slow") >= slow)
+	attest.True(t, elapsed("/fast") < slow)
+	attest.True(t, elapsed("/slow/fast") < slow)
+	attest.Equal(t, calls.Load(), int64(3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL()+"/slow", nil)
+	attest.Ok(t, err, attest.Fatal())
+	_, err = srv.Client().Do(req)
+	attest.ErrorIs(t, err, context.DeadlineExceeded)
+	attest.Ok(t, srv.Shutdown(context.Background()))
+	attest.Equal(t, calls.Load(), int64(3), attest.Sprintf("handler called after cancellation"))
+}
+
+func TestBodyLimit(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("limit %d", maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Fprintf(w, "read %d", len(body))
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithBodyLimit(map[string]int64{
+		"/":            1000,
+		"/small":       10,
+		"/small/large": 100,
+	}))
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/small", http.StatusRequestEntityTooLarge, "limit 10"},
+		{"/small/large", http.StatusOK, "read 50"},
+		{"/large", http.StatusOK, "read 50"},
+	}
+	for _, tt := range tests {
+		res, err := srv.Client().Post(srv.URL()+tt.path, "text/plain", strings.NewReader(strings.Repeat("a", 50)))
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, res.StatusCode, tt.status, attest.Sprintf("path %s", tt.path))
+		attest.Equal(t, strings.TrimSpace(string(body)), tt.body)
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	t.Parallel()
+	started := make(chan struct{})
+	poll := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-memhttp.ShuttingDown(r.Context()):
+			io.WriteString(w, "shutting down")
+		case <-time.After(10 * time.Second):
+			io.WriteString(w, "timed out")
+		}
+	})
+	srv, err := memhttp.New(poll)
+	attest.Ok(t, err, attest.Fatal())
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := srv.Client().Get(srv.URL())
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		done <- result{string(body), err}
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	attest.Ok(t, srv.Shutdown(ctx))
+	res := <-done
+	attest.Ok(t, res.err)
+	attest.Equal(t, res.body, "shutting down")
+	attest.Zero(t, memhttp.ShuttingDown(context.Background()))
+}
+
+func TestPause(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	existing := srv.Client()
+	get := func(client *http.Client, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL(), nil)
+		attest.Ok(t, err, attest.Fatal())
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = io.ReadAll(res.Body)
+		return err
+	}
+	attest.Ok(t, get(existing, time.Minute))
+
+	srv.Pause()
+	srv.Pause() // idempotent
+	err := get(srv.Client(), 20*time.Millisecond)
+	attest.ErrorIs(t, err, context.DeadlineExceeded)
+	attest.Ok(t, get(existing, time.Minute))
+
+	srv.Resume()
+	attest.Ok(t, get(srv.Client(), time.Minute))
+	srv.Resume() // idempotent
+}
+
+func TestResponseHeaders(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			return
+		case "/embed":
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		io.WriteString(w, greeting)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithResponseHeaders(http.Header{
+		"x-frame-options": []string{"DENY"},
+		"Server":          []string{"memhttp"},
+	}))
+	for path, want := range map[string]string{"/": "DENY", "/embed": "SAMEORIGIN", "/empty": "DENY"} {
+		res, err := srv.Client().Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		attest.Equal(t, res.Header.Get("X-Frame-Options"), want)
+		attest.Equal(t, res.Header.Get("Server"), "memhttp")
+	}
+}
+
+func TestServeError(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	attest.Ok(t, srv.ServeError())
+	attest.Ok(t, srv.Close())
+	attest.Ok(t, srv.ServeError())
+	attest.Ok(t, srv.Shutdown(context.Background())) // doesn't block
+
+	// net/http refuses to serve HTTP/2 without this cipher suite.
+	broken, err := memhttp.New(&greeter{}, memhttp.WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256))
+	attest.Ok(t, err, attest.Fatal())
+	deadline := time.Now().Add(5 * time.Second)
+	for broken.ServeError() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	attest.Error(t, broken.ServeError())
+	attest.Subsequence(t, broken.ServeError().Error(), "AES_128_GCM_SHA256")
+	attest.Error(t, broken.Close())
+}
+
+func TestFlushStrategy(t *testing.T) {
+	t.Parallel()
+	const writes, size = 10, 100
 	tests := []struct {
 		name string
 		opts []memhttp.Option
 	}{
 		{"default", nil},
-		{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}},
 		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
 	}
-	for _, tt := range tests {
-		tt := tt
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Run("immediate", func(t *testing.T) {
+				t.Parallel()
+				// The handler doesn't write again until the client has read the
+				// previous write, so each must be delivered on its own.
+				acks := make(chan struct{})
+				handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for i := 0; i < writes; i++ {
+						w.Write(bytes.Repeat([]byte{'a'}, size))
+						<-acks
+					}
+				})
+				opts := append([]memhttp.Option{memhttp.WithFlushStrategy(memhttp.FlushImmediately())}, tt.opts...)
+				srv := memhttptest.New(t, handler, opts...)
+				res, err := srv.Client().Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				defer res.Body.Close()
+				buf := make([]byte, size)
+				for i := 0; i < writes; i++ {
+					_, err := io.ReadFull(res.Body, buf)
+					attest.Ok(t, err, attest.Fatal())
+					acks <- struct{}{}
+				}
+			})
+			t.Run("buffered", func(t *testing.T) {
+				t.Parallel()
+				handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for i := 0; i < writes; i++ {
+						w.Write(bytes.Repeat([]byte{'a'}, size))
+					}
+				})
+				opts := append([]memhttp.Option{memhttp.WithFlushStrategy(memhttp.FlushAtSize(writes * size))}, tt.opts...)
+				srv := memhttptest.New(t, handler, opts...)
+				res, err := srv.Client().Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				defer res.Body.Close()
+				buf := make([]byte, 2*writes*size)
+				var reads, total int
+				for {
+					n, err := res.Body.Read(buf)
+					if n > 0 {
+						reads++
+						total += n
+					}
+					if err == io.EOF {
+						break
+					}
+					attest.Ok(t, err, attest.Fatal())
+				}
+				attest.Equal(t, total, writes*size)
+				attest.True(t, reads < writes, attest.Sprintf("got %d reads", reads))
+			})
+			t.Run("status", func(t *testing.T) {
+				t.Parallel()
+				handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, greeting)
+					// Like net/http, ignore status codes after the first Write.
+					w.WriteHeader(http.StatusTeapot)
+				})
+				opts := append([]memhttp.Option{memhttp.WithFlushStrategy(memhttp.FlushAtSize(1024))}, tt.opts...)
+				srv := memhttptest.New(t, handler, opts...)
+				res, err := srv.Client().Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				defer res.Body.Close()
+				attest.Equal(t, res.StatusCode, http.StatusOK)
+				body, err := io.ReadAll(res.Body)
+				attest.Ok(t, err)
+				attest.Equal(t, string(body), greeting)
+			})
+		})
+	}
+	t.Run("hijack", func(t *testing.T) {
+		t.Parallel()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				http.Error(w, "not a Hijacker", http.StatusInternalServerError)
+				return
+			}
+			conn, rw, err := hj.Hijack()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			rw.Flush()
+		})
+		opts := []memhttp.Option{memhttp.WithoutHTTP2(), memhttp.WithFlushStrategy(memhttp.FlushAtSize(1024))}
+		srv := memhttptest.New(t, handler, opts...)
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		attest.Equal(t, string(body), "hijacked")
+	})
+}
+
+func TestClockSkew(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	const skew = -90 * time.Minute
+	empty := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, handler := range []http.Handler{&greeter{}, empty} {
+		srv := memhttptest.New(t, handler, memhttp.WithClock(clock), memhttp.WithClockSkew(skew))
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		date, err := http.ParseTime(res.Header.Get("Date"))
+		attest.Ok(t, err)
+		attest.Equal(t, date, clock.Now().Add(skew).UTC().Truncate(time.Second))
+	}
+}
+
+func TestShutdownError(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" {
+			close(started)
+			<-release
+		}
+	})
+	srv, err := memhttp.New(handler)
+	attest.Ok(t, err, attest.Fatal())
+	go func() {
+		res, err := srv.Client().Get(srv.URL() + "/stuck?q=1")
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	attest.ErrorIs(t, err, context.DeadlineExceeded)
+	var shutdownErr *memhttp.ShutdownError
+	attest.True(t, errors.As(err, &shutdownErr), attest.Fatal())
+	attest.Equal(t, len(shutdownErr.InFlight), 1, attest.Fatal())
+	attest.Equal(t, shutdownErr.InFlight[0].Method, http.MethodGet)
+	attest.Equal(t, shutdownErr.InFlight[0].URL, "example.com/stuck?q=1")
+	attest.Subsequence(t, err.Error(), "GET example.com/stuck?q=1 HTTP/2.0")
+	close(release)
+	attest.Ok(t, srv.Close())
+}
+
+func TestTLSDial(t *testing.T) {
+	t.Parallel()
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	tests := []struct {
+		name    string
+		opts    []memhttp.Option
+		cfg     func(*memhttp.Server) *tls.Config
+		proto   string
+		version uint16
+	}{
+		{"default", nil, nil, "h2", tls.VersionTLS13},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}, nil, "http/1.1", tls.VersionTLS13},
+		{"custom", nil, func(srv *memhttp.Server) *tls.Config {
+			cfg := srv.Transport().TLSClientConfig
+			cfg.MaxVersion = tls.VersionTLS12
+			return cfg
+		}, "", tls.VersionTLS12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := memhttptest.New(t, handler, tt.opts...)
+			var cfg *tls.Config
+			if tt.cfg != nil {
+				cfg = tt.cfg(srv)
+			}
+			conn, err := srv.TLSDial(context.Background(), cfg)
+			attest.Ok(t, err, attest.Fatal())
+			defer conn.Close()
+			state := conn.ConnectionState()
+			attest.True(t, state.HandshakeComplete)
+			attest.Equal(t, state.NegotiatedProtocol, tt.proto)
+			attest.Equal(t, state.Version, tt.version)
+			attest.Equal(t, state.PeerCertificates[0].DNSNames, []string{"example.com"})
+			attest.Equal(t, srv.LastCipherSuite(), state.CipherSuite)
+		})
+	}
+	attest.Zero(t, requests)
+	_, err := memhttptest.New(t, handler, memhttp.WithoutTLS()).TLSDial(context.Background(), nil)
+	attest.Error(t, err)
+}
+
+func TestRequiredALPN(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithRequiredALPN("h2"))
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.ProtoMajor, 2)
+
+	transport := srv.Transport()
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	res, err = (&http.Client{Transport: transport}).Get(srv.URL())
+	if err == nil {
+		res.Body.Close()
+	}
+	attest.Error(t, err)
+}
+
+func TestStreamResets(t *testing.T) {
+	t.Parallel()
+	started := make(chan struct{})
+	srv, err := memhttp.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	attest.Ok(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := srv.Client().Do(req)
+		errs <- err
+	}()
+	<-started
+	attest.Zero(t, srv.StreamResets())
+	cancel()
+	attest.ErrorIs(t, <-errs, context.Canceled)
+	// The reset is counted once the handler returns.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.StreamResets() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	attest.Equal(t, srv.StreamResets(), 1)
+	attest.Ok(t, srv.Shutdown(context.Background()))
+}
+
+func TestStrictTLS(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.New(&greeter{}, memhttp.WithStrictTLS())
+	attest.Ok(t, err)
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err)
+	res.Body.Close()
+	attest.Ok(t, srv.ServeError())
+
+	// A client that doesn't trust the server's certificate aborts the
+	// handshake.
+	untrusted := srv.Transport()
+	untrusted.TLSClientConfig.RootCAs = x509.NewCertPool()
+	_, err = (&http.Client{Transport: untrusted}).Get(srv.URL())
+	attest.Error(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.ServeError() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	attest.Error(t, srv.ServeError())
+	attest.True(t, strings.Contains(srv.ServeError().Error(), "tls handshake"))
+	attest.Error(t, srv.Shutdown(context.Background()))
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	t.Parallel()
+	const idle = 50 * time.Millisecond
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := memhttptest.New(t, &greeter{}, append(tt.opts, memhttp.WithConnIdleTimeout(idle))...)
+			client := srv.Client()
+			dials := countDials(client)
+			get := func() {
+				res, err := client.Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				_, err = io.Copy(io.Discard, res.Body)
+				attest.Ok(t, err)
+				res.Body.Close()
+			}
+			get()
+			get()
+			attest.Equal(t, dials(), 1, attest.Sprintf("active connection reaped"))
+			time.Sleep(3 * idle)
+			get()
+			attest.Equal(t, dials(), 2, attest.Sprintf("idle connection not reaped"))
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	const (
+		// Long enough for concurrent TLS handshakes under the race detector.
+		idle     = 250 * time.Millisecond
+		requests = 20
+	)
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := memhttptest.New(t, &greeter{}, append(tt.opts, memhttp.WithConnIdleTimeout(idle))...)
+			attest.Equal(t, srv.Stats(), memhttp.Stats{})
+			client := srv.Client()
+			var wg sync.WaitGroup
+			for range requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res, err := client.Get(srv.URL())
+					if !attest.Ok(t, err) {
+						return
+					}
+					_, err = io.Copy(io.Discard, res.Body)
+					attest.Ok(t, err)
+					res.Body.Close()
+				}()
+			}
+			wg.Wait()
+			stats := srv.Stats()
+			attest.Equal(t, stats.TotalRequests, int64(requests))
+			attest.True(t, stats.TotalConns >= 1, attest.Sprintf("no conns counted"))
+			attest.True(t, stats.ActiveConns >= 1, attest.Sprintf("keep-alive conns closed early"))
+
+			deadline := time.Now().Add(10 * idle)
+			for srv.Stats().ActiveConns > 0 && time.Now().Before(deadline) {
+				time.Sleep(idle)
+			}
+			stats = srv.Stats()
+			attest.Zero(t, stats.ActiveConns, attest.Sprintf("idle conns not closed"))
+			attest.Equal(t, stats.TotalRequests, int64(requests))
+		})
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		attest.Ok(t, err)
+		fmt.Fprintf(w, "read %q", body)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithoutTLS())
+	conn, err := srv.Transport().DialContext(context.Background(), "tcp", srv.Addr().String()+":80")
+	attest.Ok(t, err, attest.Fatal())
+	defer conn.Close()
+	req, err := http.NewRequest(http.MethodPost, srv.URL(), strings.NewReader("hello"))
+	attest.Ok(t, err, attest.Fatal())
+	attest.Ok(t, req.Write(conn), attest.Fatal())
+	hc, ok := conn.(interface{ CloseWrite() error })
+	attest.True(t, ok, attest.Fatal())
+	attest.Ok(t, hc.CloseWrite())
+	_, err = conn.Write([]byte("more"))
+	attest.Error(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, res.StatusCode, http.StatusOK)
+	attest.Equal(t, string(body), `read "hello"`)
+}
+
+func TestBaseContext(t *testing.T) {
+	t.Parallel()
+	type key struct{}
+	base, cancel := context.WithCancelCause(context.WithValue(context.Background(), key{}, "value"))
+	defer cancel(nil)
+	deadline := time.Now().Add(time.Hour)
+	base, cancelDeadline := context.WithDeadline(base, deadline)
+	defer cancelDeadline()
+	stopped := errors.New("stopped by test")
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, fmt.Sprint(r.Context().Value(key{})))
+		if d, ok := r.Context().Deadline(); !ok || !d.Equal(deadline) {
+			io.WriteString(w, " without deadline")
+		}
+		if r.URL.Path != "/wait" {
+			return
+		}
+		close(started)
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithBaseContext(func(net.Listener) context.Context {
+		return base
+	}))
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "value")
+
+	go func() {
+		if res, err := srv.Client().Get(srv.URL() + "/wait"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	cancel(stopped)
+	attest.ErrorIs(t, <-causes, stopped)
+}
+
+func TestConnState(t *testing.T) {
+	t.Parallel()
+	http1 := []http.ConnState{
+		http.StateNew,
+		http.StateActive, http.StateIdle,
+		http.StateActive, http.StateIdle,
+		http.StateClosed,
+	}
+	// Like a TCP server, the HTTP/2 server is briefly active while it
+	// exchanges connection prefaces.
+	http2 := []http.ConnState{
+		http.StateNew,
+		http.StateActive, http.StateIdle,
+		http.StateActive, http.StateIdle,
+		http.StateActive, http.StateIdle,
+		http.StateClosed,
+	}
+	tests := []struct {
+		name string
+		opts []memhttp.Option
+		want []http.ConnState
+	}{
+		{"default", nil, http2},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}, http1},
+		{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}, http1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var (
+				mu     sync.Mutex
+				states []http.ConnState
+			)
+			observed := func() []http.ConnState {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]http.ConnState(nil), states...)
+			}
+			srv, err := memhttp.New(&greeter{}, append(tt.opts, memhttp.WithConnState(func(_ net.Conn, state http.ConnState) {
+				mu.Lock()
+				defer mu.Unlock()
+				states = append(states, state)
+			}))...)
+			attest.Ok(t, err, attest.Fatal())
+			client := srv.Client()
+			for i := 0; i < 2; i++ {
+				res, err := client.Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				_, err = io.Copy(io.Discard, res.Body)
+				attest.Ok(t, err)
+				res.Body.Close()
+			}
+			attest.Ok(t, srv.Shutdown(context.Background()))
+			// StateClosed is reported asynchronously.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(observed()) < len(tt.want) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			attest.Equal(t, observed(), tt.want)
+		})
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	t.Parallel()
+	var newConns atomic.Int64
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithoutHTTP2(), memhttp.WithHTTPServer(func(s *http.Server) {
+		s.MaxHeaderBytes = 1
+		connState := s.ConnState
+		s.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns.Add(1)
+			}
+			connState(conn, state)
+		}
+	}))
+	req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err, attest.Fatal())
+	req.Header.Set("X-Large", strings.Repeat("x", 8192))
+	res, err := srv.Client().Do(req)
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	attest.Equal(t, newConns.Load(), int64(1))
+}
+
+func TestH2C(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "%s %d\n", r.Proto, i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithH2C())
+	attest.True(t, strings.HasPrefix(srv.URL(), "http://"))
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	attest.Equal(t, res.ProtoMajor, 2)
+	attest.Zero(t, res.TLS)
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "HTTP/2.0 0\nHTTP/2.0 1\nHTTP/2.0 2\n")
+
+	http1 := &http.Client{Transport: &http.Transport{DialContext: srv.Transport().DialContext}}
+	res, err = http1.Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.ProtoMajor, 1)
+}
+
+func TestManualStart(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithManualStart())
+	errs := make(chan error, 1)
+	go func() {
+		res, err := srv.Client().Get(srv.URL())
+		if err == nil {
+			err = res.Body.Close()
+		}
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("request to unstarted server finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	attest.Ok(t, srv.Start())
+	attest.Ok(t, <-errs)
+	attest.Error(t, srv.Start())
+
+	unstarted, err := memhttp.New(&greeter{}, memhttp.WithManualStart())
+	attest.Ok(t, err, attest.Fatal())
+	attest.Ok(t, unstarted.Close())
+	attest.True(t, unstarted.Closed())
+}
+
+func TestDialTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 20 * time.Millisecond
+	srv, err := memhttp.New(&greeter{}, memhttp.WithoutTLS(), memhttp.WithDialTimeout(timeout))
+	attest.Ok(t, err)
+	dial := srv.Transport().DialContext
+
+	srv.Pause()
+	start := time.Now()
+	_, err = dial(context.Background(), "tcp", "example.com:80")
+	attest.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	attest.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	attest.True(t, time.Since(start) < 5*time.Second)
+	srv.Resume()
+
+	attest.Ok(t, srv.Close())
+	start = time.Now()
+	_, err = dial(context.Background(), "tcp", "example.com:80")
+	attest.Error(t, err)
+	attest.True(t, time.Since(start) < timeout+time.Second)
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithoutTLS(), memhttp.WithAcceptBacklog(1))
+	dial := srv.Transport().DialContext
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		_, err := dial(ctx, "tcp", "example.com:80")
+		attest.ErrorIs(t, err, context.Canceled)
+	}
+
+	srv.Pause()
+	queued, err := dial(context.Background(), "tcp", "example.com:80") // fills the backlog
+	attest.Ok(t, err, attest.Fatal())
+	defer queued.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := dial(ctx, "tcp", "example.com:80")
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	attest.ErrorIs(t, <-errs, context.Canceled)
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	t.Parallel()
+	for _, backlog := range []int{0, 2} {
+		t.Run(fmt.Sprint(backlog), func(t *testing.T) {
+			t.Parallel()
+			srv := memhttptest.New(t, &greeter{}, memhttp.WithoutTLS(), memhttp.WithAcceptBacklog(backlog))
+			dial := srv.Transport().DialContext
+			srv.Pause()
+			var queued []net.Conn
+			for i := 0; i <= backlog; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				conn, err := dial(ctx, "tcp", "example.com:80")
+				cancel()
+				if i < backlog {
+					attest.Ok(t, err, attest.Fatal())
+					queued = append(queued, conn)
+				} else {
+					attest.ErrorIs(t, err, context.DeadlineExceeded)
+				}
+			}
+			srv.Resume()
+			// Connections queued while paused are served after resuming.
+			for _, conn := range queued {
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+				res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				attest.Ok(t, err, attest.Fatal())
+				attest.Equal(t, res.StatusCode, http.StatusOK)
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestConnFromContext(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := memhttp.ConnFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no conn", http.StatusInternalServerError)
+			return
+		}
+		_, isTLS := conn.(*tls.Conn)
+		fmt.Fprintf(w, "%s %t", conn.LocalAddr().Network(), isTLS)
+	})
+	for _, tt := range []struct {
+		opts []memhttp.Option
+		want string
+	}{
+		{nil, "memory true"},
+		{[]memhttp.Option{memhttp.WithoutTLS()}, "memory false"},
+	} {
+		srv := memhttptest.New(t, handler, tt.opts...)
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, string(body), tt.want)
+	}
+	_, ok := memhttp.ConnFromContext(context.Background())
+	attest.False(t, ok)
+}
+
+func TestRedirects(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dest", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "arrived")
+	})
+	mux.HandleFunc("/relative", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/dest", http.StatusFound)
+	})
+	mux.HandleFunc("/absolute", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/dest", http.StatusFound)
+	})
+	mux.HandleFunc("/cross", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://other.example/dest", http.StatusFound)
+	})
+	srv := memhttptest.New(t, mux)
+	client := srv.Client()
+	for _, path := range []string{"/relative", "/absolute"} {
+		res, err := client.Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, res.Request.URL.Path, "/dest")
+		attest.Equal(t, string(body), "arrived")
+	}
+	_, err := client.Get(srv.URL() + "/cross")
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "other.example")
+}
+
+func TestDrainConns(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		opts []memhttp.Option
+	}{
+		{"http2", nil},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			started, release := make(chan struct{}), make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					close(started)
+					<-release
+				}
+				io.WriteString(w, greeting)
+			})
+			type transition struct {
+				conn  net.Conn
+				state http.ConnState
+			}
+			transitions := make(chan transition, 64)
+			trackState := memhttp.WithConnState(func(conn net.Conn, state http.ConnState) {
+				transitions <- transition{conn, state}
+			})
+			states := make(map[net.Conn]http.ConnState)
+			// waitIdle waits until the server has finished with all the
+			// responses on open connections.
+			waitIdle := func() {
+				for {
+					select {
+					case tr := <-transitions:
+						states[tr.conn] = tr.state
+						continue
+					default:
+					}
+					idle := true
+					for _, state := range states {
+						if state == http.StateNew || state == http.StateActive {
+							idle = false
+						}
+					}
+					if idle {
+						return
+					}
+					tr := <-transitions
+					states[tr.conn] = tr.state
+				}
+			}
+			srv := memhttptest.New(t, handler, append(tt.opts, trackState)...)
+			client, dials := countingClient(srv)
+			closed := notifyClose(client)
+			get := func(path string) {
+				res, err := client.Get(srv.URL() + path)
+				attest.Ok(t, err)
+				if err == nil {
+					io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+				}
+			}
+
+			// Active connections finish in-flight requests.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				get("/slow")
+			}()
+			<-started
+			srv.DrainConns()
+			close(release)
+			<-done
+			attest.Equal(t, dials(), 1)
+			// Once the client closes its end of the drained connection, it
+			// won't reuse it.
+			<-closed
+			get("/fast")
+			attest.Equal(t, dials(), 2)
+
+			// The very next request after DrainConns avoids idle connections.
+			waitIdle()
+			srv.DrainConns()
+			<-closed
+			get("/fast")
+			attest.Equal(t, dials(), 3)
+		})
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	t.Parallel()
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			const max = 2
+			opts := append([]memhttp.Option{memhttp.WithMaxRequestsPerConn(max)}, tt.opts...)
+			empty := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+			for _, handler := range []http.Handler{&greeter{}, empty} {
+				srv := memhttptest.New(t, handler, opts...)
+				client, dials := countingClient(srv)
+				for i := 0; i <= max; i++ {
+					res, err := client.Get(srv.URL())
+					attest.Ok(t, err, attest.Fatal())
+					io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+				}
+				attest.Equal(t, dials(), 2)
+			}
+		})
+	}
+}
+
+func TestCertificateValidity(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	get := func(t *testing.T, opts ...memhttp.Option) error {
+		srv := memhttptest.New(t, &greeter{}, opts...)
+		res, err := srv.Client().Get(srv.URL())
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	t.Run("expired", func(t *testing.T) {
+		t.Parallel()
+		err := get(t, memhttp.WithCertificateValidity(now.Add(-2*time.Hour), now.Add(-time.Hour)))
+		attest.Error(t, err)
+		attest.Subsequence(t, err.Error(), "certificate has expired")
+	})
+	t.Run("not yet valid", func(t *testing.T) {
+		t.Parallel()
+		err := get(t, memhttp.WithCertificateValidity(now.Add(time.Hour), now.Add(2*time.Hour)))
+		attest.Error(t, err)
+		attest.Subsequence(t, err.Error(), "not yet valid")
+	})
+	t.Run("simulated time", func(t *testing.T) {
+		t.Parallel()
+		clock := newFakeClock()
+		clock.Advance(90 * time.Minute)
+		err := get(
+			t,
+			memhttp.WithCertificateValidity(now.Add(time.Hour), now.Add(2*time.Hour)),
+			memhttp.WithClock(clock),
+		)
+		attest.Ok(t, err)
+	})
+}
+
+func TestKeyType(t *testing.T) {
+	t.Parallel()
+	// acceptOnly returns a client that only accepts server certificates with
+	// the given public key algorithm.
+	acceptOnly := func(srv *memhttp.Server, alg x509.PublicKeyAlgorithm) *http.Client {
+		transport := srv.Transport()
+		transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if got := state.PeerCertificates[0].PublicKeyAlgorithm; got != alg {
+				return fmt.Errorf("server certificate uses %v, want %v", got, alg)
+			}
+			return nil
+		}
+		return &http.Client{Transport: transport}
+	}
+	tests := []struct {
+		name    string
+		keyType memhttp.KeyType
+		alg     x509.PublicKeyAlgorithm
+		other   x509.PublicKeyAlgorithm
+	}{
+		{"embedded", 0, x509.RSA, x509.ECDSA},
+		{"rsa", memhttp.RSA2048, x509.RSA, x509.ECDSA},
+		{"ecdsa", memhttp.ECDSAP256, x509.ECDSA, x509.RSA},
+		{"ed25519", memhttp.Ed25519, x509.Ed25519, x509.RSA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var opts []memhttp.Option
+			if tt.keyType != 0 {
+				opts = append(opts, memhttp.WithKeyType(tt.keyType))
+			}
+			srv := memhttptest.New(t, &greeter{}, opts...)
+			res, err := acceptOnly(srv, tt.alg).Get(srv.URL())
+			attest.Ok(t, err, attest.Fatal())
+			res.Body.Close()
+			_, err = acceptOnly(srv, tt.other).Get(srv.URL())
+			attest.Error(t, err)
+		})
+	}
+}
+
+func TestWithoutHostnameVerification(t *testing.T) {
+	t.Parallel()
+	get := func(srv *memhttp.Server, serverName string, roots *x509.CertPool) error {
+		transport := srv.Transport()
+		transport.TLSClientConfig.ServerName = serverName
+		if roots != nil {
+			transport.TLSClientConfig.RootCAs = roots
+		}
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	// The certificate doesn't cover example.com.
+	strict := memhttptest.New(t, &greeter{}, memhttp.WithGeneratedCert("other.test"))
+	attest.Ok(t, get(strict, "other.test", nil))
+	attest.Error(t, get(strict, "example.com", nil))
+
+	lax := memhttptest.New(t, &greeter{}, memhttp.WithGeneratedCert("other.test"), memhttp.WithoutHostnameVerification())
+	attest.Ok(t, get(lax, "example.com", nil))
+	// The chain is still verified.
+	attest.Error(t, get(lax, "example.com", x509.NewCertPool()))
+}
+
+func TestGeneratedCert(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithGeneratedCert("api.internal", "alt.internal", "10.0.0.1"))
+	get := func(serverName string) (string, error) {
+		transport := srv.Transport()
+		defer transport.CloseIdleConnections()
+		if serverName != "" {
+			transport.TLSClientConfig.ServerName = serverName
+		}
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+	for _, name := range []string{"", "alt.internal", "10.0.0.1"} {
+		sni, err := get(name)
+		attest.Ok(t, err)
+		if name == "" {
+			attest.Equal(t, sni, "api.internal")
+		} else if net.ParseIP(name) == nil {
+			attest.Equal(t, sni, name) // IP addresses aren't sent via SNI
+		}
+	}
+	_, err := get("example.com")
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "certificate is valid for api.internal")
+
+	var resolver memhttp.Resolver
+	resolver.Register("alt.internal", srv)
+	res, err := resolver.Client().Get("https://alt.internal/")
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "alt.internal")
+}
+
+func TestCertificate(t *testing.T) {
+	t.Parallel()
+	ca, err := memhttp.NewCA()
+	attest.Ok(t, err, attest.Fatal())
+	cert, err := ca.IssueServer("custom.internal")
+	attest.Ok(t, err, attest.Fatal())
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithCertificate(cert))
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.StatusCode, http.StatusOK)
+	attest.True(t, res.TLS.PeerCertificates[0].Equal(cert.Leaf))
+	attest.Equal(t, res.TLS.PeerCertificates[0].DNSNames, []string{"custom.internal"})
+
+	_, err = memhttp.New(&greeter{}, memhttp.WithCertificate(tls.Certificate{}))
+	attest.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+	clientCA, err := memhttp.NewCA()
+	attest.Ok(t, err, attest.Fatal())
+	var verified atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithTLSConfig(&tls.Config{
+		ClientCAs:  clientCA.CertPool(),
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		VerifyConnection: func(tls.ConnectionState) error {
+			verified.Add(1)
+			return nil
+		},
+	}))
+
+	_, err = srv.Client().Get(srv.URL())
+	attest.Error(t, err)
+
+	alice, err := clientCA.IssueClient("alice")
+	attest.Ok(t, err, attest.Fatal())
+	res, err := srv.ClientWithCertificate(alice).Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "alice")
+	attest.Equal(t, res.ProtoMajor, 2)
+	attest.Equal(t, verified.Load(), int64(1))
+	attest.Equal(t, srv.LastCipherSuite(), res.TLS.CipherSuite)
+}
+
+func TestClientCA(t *testing.T) {
+	t.Parallel()
+	ca, err := memhttp.NewCA()
+	attest.Ok(t, err, attest.Fatal())
+	other, err := memhttp.NewCA()
+	attest.Ok(t, err, attest.Fatal())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithCA(ca), memhttp.WithClientCA(ca))
+	attest.True(t, srv.Transport().TLSClientConfig.RootCAs.Equal(ca.CertPool()))
+
+	alice, err := ca.IssueClient("alice")
+	attest.Ok(t, err, attest.Fatal())
+	res, err := srv.ClientWithCertificate(alice).Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "alice")
+
+	mallory, err := other.IssueClient("mallory")
+	attest.Ok(t, err, attest.Fatal())
+	_, err = srv.ClientWithCertificate(mallory).Get(srv.URL())
+	attest.Error(t, err)
+	_, err = srv.Client().Get(srv.URL())
+	attest.Error(t, err)
+
+	// Server certificates issued by the CA work with other TLS servers.
+	cert, err := ca.IssueServer("api.internal")
+	attest.Ok(t, err, attest.Fatal())
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "api.internal", Roots: ca.CertPool()})
+	attest.Ok(t, err)
+}
+
+func TestAddr(t *testing.T) {
+	t.Parallel()
+	for _, opts := range [][]memhttp.Option{nil, {memhttp.WithoutTLS()}} {
+		srv := memhttptest.New(t, &greeter{}, opts...)
+		u, err := url.Parse(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		attest.Equal(t, srv.Addr().String(), u.Host)
+		attest.Equal(t, srv.Addr().Network(), "memory")
+	}
+}
+
+func TestPlaintextListener(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		io.WriteString(w, "secure "+r.URL.Path)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithPlaintextListener())
+	attest.Equal(t, srv.URL(), "https://example.com")
+	attest.Equal(t, srv.PlaintextURL(), "http://example.com")
+	res, err := srv.Client().Get(srv.PlaintextURL() + "/login")
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "secure /login")
+	attest.Equal(t, res.Request.URL.String(), "https://example.com/login")
+
+	var resolver memhttp.Resolver
+	resolver.Register("app.test", srv)
+	res, err = resolver.Client().Get("http://app.test/resolved")
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err = io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "secure /resolved")
+
+	tlsOnly := memhttptest.New(t, handler)
+	attest.Zero(t, tlsOnly.PlaintextURL())
+	plaintext := memhttptest.New(t, handler, memhttp.WithoutTLS())
+	attest.Equal(t, plaintext.PlaintextURL(), plaintext.URL())
+}
+
+func TestPlaintextListenerSharedState(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			hits.Add(1)
+		}
+		fmt.Fprint(w, hits.Load())
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithPlaintextListener())
+	client := srv.Client()
+	for i := 0; i < 3; i++ {
+		res, err := client.Post(srv.PlaintextURL(), "text/plain", nil)
+		attest.Ok(t, err, attest.Fatal())
+		attest.True(t, res.TLS == nil)
+		res.Body.Close()
+	}
+	res, err := client.Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	attest.NotZero(t, res.TLS)
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), "3")
+}
+
+func TestSingleConnClient(t *testing.T) {
+	t.Parallel()
+	for _, tt := range protocols {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			const concurrency = 100
 			srv := memhttptest.New(t, &greeter{}, tt.opts...)
+			client := srv.SingleConnClient()
+			dials := countDials(client)
 			var wg sync.WaitGroup
-			start := make(chan struct{})
-			for i := 0; i < concurrency; i++ {
+			for i := 0; i < 10; i++ {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					client := srv.Client()
-					req, err := http.NewRequestWithContext(
-						context.Background(),
-						http.MethodGet,
-						srv.URL(),
-						strings.NewReader(""),
-					)
-					attest.Ok(t, err)
-					<-start
-					res, err := client.Do(req)
+					res, err := client.Get(srv.URL())
 					attest.Ok(t, err)
-					attest.Equal(t, res.StatusCode, http.StatusOK, attest.Continue())
-					body, err := io.ReadAll(res.Body)
-					attest.Ok(t, err)
-					attest.Equal(t, string(body), greeting)
+					if err == nil {
+						io.Copy(io.Discard, res.Body)
+						res.Body.Close()
+					}
 				}()
 			}
-			close(start)
 			wg.Wait()
+			attest.Equal(t, dials(), 1)
 		})
 	}
 }
 
-func TestRegisterOnShutdown(t *testing.T) {
+func TestResolver(t *testing.T) {
 	t.Parallel()
-	srv, err := memhttp.New(&greeter{})
-	attest.Ok(t, err)
-	done := make(chan struct{})
-	srv.RegisterOnShutdown(func() {
-		close(done)
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.Host)
+		})
+	}
+	var resolver memhttp.Resolver
+	resolver.Register("alpha.test", memhttptest.New(t, named("alpha")))
+	resolver.Register("beta.test", memhttptest.New(t, named("beta"), memhttp.WithoutHTTP2()))
+	resolver.Register("gamma.test", memhttptest.New(t, named("gamma"), memhttp.WithoutTLS()))
+	client := resolver.Client()
+	tests := []struct {
+		url   string
+		body  string
+		proto string
+	}{
+		{"https://alpha.test/", "alpha alpha.test", "HTTP/2.0"},
+		{"https://beta.test:8443/", "beta beta.test:8443", "HTTP/1.1"},
+		{"http://gamma.test/", "gamma gamma.test", "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		res, err := client.Get(tt.url)
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, string(body), tt.body)
+		attest.Equal(t, res.Proto, tt.proto)
+	}
+	for _, url := range []string{"https://unknown.test/", "http://unknown.test/"} {
+		start := time.Now()
+		_, err := client.Get(url)
+		attest.True(t, time.Since(start) < time.Second, attest.Sprintf("dial took %v", time.Since(start)))
+		attest.Error(t, err)
+		attest.Subsequence(t, err.Error(), "unknown.test")
+		var dnsErr *net.DNSError
+		attest.True(t, errors.As(err, &dnsErr), attest.Fatal())
+		attest.True(t, dnsErr.IsNotFound)
+		attest.Equal(t, dnsErr.Name, "unknown.test")
+	}
+}
+
+func TestDialOtherHost(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, &greeter{})
+	_, err := srv.Client().Get("https://other.test/")
+	attest.Error(t, err)
+	var dnsErr *net.DNSError
+	attest.True(t, errors.As(err, &dnsErr), attest.Fatal())
+	attest.True(t, dnsErr.IsNotFound)
+	attest.Equal(t, dnsErr.Name, "other.test")
+	var opErr *net.OpError
+	attest.True(t, errors.As(err, &opErr), attest.Fatal())
+	attest.Equal(t, opErr.Op, "dial")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Parallel()
+	cancelled := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled <- r.Context().Err()
+	})
+	srv := memhttptest.New(
+		t,
+		handler,
+		memhttp.WithRequestTimeout(10*time.Millisecond),
+		memhttp.WithHARCapture(),
+	)
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	attest.Equal(t, res.StatusCode, http.StatusServiceUnavailable)
+	attest.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+}
+
+func TestLastCipherSuite(t *testing.T) {
+	t.Parallel()
+	const suite = tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithCipherSuites(suite))
+	attest.Zero(t, srv.LastCipherSuite())
+	transport := srv.Transport()
+	transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+	defer transport.CloseIdleConnections()
+	res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Equal(t, res.TLS.CipherSuite, suite)
+	attest.Equal(t, srv.LastCipherSuite(), suite)
+
+	plain := memhttptest.New(t, &greeter{}, memhttp.WithoutTLS())
+	res, err = plain.Client().Get(plain.URL())
+	attest.Ok(t, err, attest.Fatal())
+	res.Body.Close()
+	attest.Zero(t, plain.LastCipherSuite())
+}
+
+func TestCipherSuites(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(
+		t,
+		&greeter{},
+		memhttp.WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+	)
+	transport := srv.Transport()
+	transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+	transport.TLSClientConfig.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	defer transport.CloseIdleConnections()
+	_, err := (&http.Client{Transport: transport}).Get(srv.URL())
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "handshake failure")
+}
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var calls int
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Call", fmt.Sprint(calls))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	})
+	replay := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler called in replay: %s %s", r.Method, r.URL)
 	})
+	type result struct {
+		Status int
+		Call   string
+		Body   string
+	}
+	exchange := func(srv *memhttp.Server) []result {
+		var results []result
+		for _, body := range []string{"", "one", "two"} {
+			req, err := http.NewRequest(http.MethodPost, srv.URL()+"/path?q=1", strings.NewReader(body))
+			attest.Ok(t, err, attest.Fatal())
+			res, err := srv.Client().Do(req)
+			attest.Ok(t, err, attest.Fatal())
+			got, err := io.ReadAll(res.Body)
+			attest.Ok(t, err)
+			res.Body.Close()
+			results = append(results, result{res.StatusCode, res.Header.Get("X-Call"), string(got)})
+		}
+		return results
+	}
+	recorded := exchange(memhttptest.New(t, record, memhttp.WithRecordReplay(dir)))
+	attest.Equal(t, calls, 3)
+	attest.Equal(t, recorded[2], result{http.StatusCreated, "3", "POST /path?q=1 two"})
+	replayed := exchange(memhttptest.New(t, replay, memhttp.WithRecordReplay(dir)))
+	attest.Equal(t, replayed, recorded)
+}
+
+func TestErrorLog(t *testing.T) {
+	t.Parallel()
+	var (
+		mu  sync.Mutex
+		out strings.Builder
+	)
+	logger := log.New(writerFunc(func(bs []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(bs)
+	}), "" /* prefix */, 0 /* flags */)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})
+	srv, err := memhttp.New(handler, memhttp.WithErrorLog(logger))
+	attest.Ok(t, err, attest.Fatal())
+	_, err = srv.Client().Get(srv.URL())
+	attest.Error(t, err)
 	attest.Ok(t, srv.Shutdown(context.Background()))
+	mu.Lock()
+	defer mu.Unlock()
+	attest.Subsequence(t, out.String(), "panic serving")
+	attest.Subsequence(t, out.String(), "oops")
+}
+
+func TestName(t *testing.T) {
+	t.Parallel()
+	var (
+		mu  sync.Mutex
+		out []string
+	)
+	logger := log.New(writerFunc(func(bs []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		out = append(out, string(bs))
+		return len(bs), nil
+	}), "" /* prefix */, 0 /* flags */)
+	for _, name := range []string{"service-a", "service-b"} {
+		// Replacing the fixture directory with a file mid-request makes
+		// recording fail, so the server logs.
+		dir := filepath.Join(t.TempDir(), "fixtures")
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attest.Ok(t, os.WriteFile(dir, nil, 0o644))
+		})
+		srv, err := memhttp.New(
+			handler,
+			memhttp.WithName(name),
+			memhttp.WithErrorLog(logger),
+			memhttp.WithRecordReplay(dir),
+		)
+		attest.Ok(t, err, attest.Fatal())
+		attest.Equal(t, srv.Name(), name)
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		attest.Ok(t, srv.Shutdown(context.Background()))
+	}
+	attest.Equal(t, len(out), 2, attest.Fatal())
+	attest.True(t, strings.HasPrefix(out[0], "[service-a] memhttp: record fixture"), attest.Sprintf("got %q", out[0]))
+	attest.True(t, strings.HasPrefix(out[1], "[service-b] memhttp: record fixture"), attest.Sprintf("got %q", out[1]))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(bs []byte) (int, error) { return f(bs) }
+
+func TestForceChunked(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		opts     []memhttp.Option
+		encoding []string
+	}{
+		{"default", nil, nil},
+		{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}, []string{"chunked"}},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}, []string{"chunked"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", fmt.Sprint(2*len(greeting)))
+				io.WriteString(w, greeting)
+				io.WriteString(w, greeting)
+			})
+			opts := append([]memhttp.Option{memhttp.WithForceChunked()}, tt.opts...)
+			srv := memhttptest.New(t, handler, opts...)
+			res, err := srv.Client().Get(srv.URL())
+			attest.Ok(t, err, attest.Fatal())
+			defer res.Body.Close()
+			attest.Equal(t, res.ContentLength, -1)
+			attest.Equal(t, res.TransferEncoding, tt.encoding)
+			body, err := io.ReadAll(res.Body)
+			attest.Ok(t, err)
+			attest.Equal(t, string(body), greeting+greeting)
+		})
+	}
+}
+
+func TestConnectionBuffer(t *testing.T) {
+	t.Parallel()
+	const size = 1024
+	t.Run("write", func(t *testing.T) {
+		t.Parallel()
+		srv := memhttptest.New(
+			t,
+			&greeter{},
+			memhttp.WithoutTLS(),
+			memhttp.WithAcceptBacklog(1),
+			memhttp.WithConnectionBuffer(size),
+		)
+		srv.Pause() // nothing reads from the connection
+		conn, err := srv.Transport().DialContext(context.Background(), "tcp", "example.com:80")
+		attest.Ok(t, err, attest.Fatal())
+		defer conn.Close()
+		attest.Ok(t, conn.SetWriteDeadline(time.Now().Add(20*time.Millisecond)))
+		n, err := conn.Write(make([]byte, size))
+		attest.Ok(t, err)
+		attest.Equal(t, n, size)
+		_, err = conn.Write([]byte{0})
+		attest.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+	for _, p := range protocols {
+		t.Run(p.name, func(t *testing.T) {
+			t.Parallel()
+			payload := bytes.Repeat([]byte("memhttp"), 64*1024)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(payload)
+			})
+			srv := memhttptest.New(t, handler, append(p.opts, memhttp.WithConnectionBuffer(size))...)
+			for i := 0; i < 3; i++ {
+				res, err := srv.Client().Get(srv.URL())
+				attest.Ok(t, err, attest.Fatal())
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				attest.Ok(t, err)
+				attest.True(t, bytes.Equal(body, payload), attest.Sprintf("body corrupted"))
+			}
+		})
+	}
+}
+
+func TestLatency(t *testing.T) {
+	t.Parallel()
+	const latency = 50 * time.Millisecond
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithLatency(latency))
+	client := srv.Client()
+	for i := 0; i < 2; i++ { // new and reused connections
+		start := time.Now()
+		res, err := client.Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		_, err = io.Copy(io.Discard, res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.True(t, time.Since(start) >= latency, attest.Sprintf("round trip took %v", time.Since(start)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), latency/2)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err, attest.Fatal())
+	start := time.Now()
+	_, err = client.Do(req)
+	attest.ErrorIs(t, err, context.DeadlineExceeded)
+	attest.True(t, time.Since(start) < 2*latency, attest.Sprintf("canceled request took %v", time.Since(start)))
+}
+
+func TestBandwidth(t *testing.T) {
+	t.Parallel()
+	const (
+		bandwidth = 100 * 1024
+		size      = 20 * 1024
+	)
+	payload := bytes.Repeat([]byte{'a'}, size)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithoutTLS(), memhttp.WithBandwidth(bandwidth))
+	start := time.Now()
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start)
+	attest.Ok(t, err)
+	attest.Equal(t, len(body), size)
+	want := time.Duration(size) * time.Second / bandwidth
+	attest.True(t, elapsed >= want && elapsed < 5*want, attest.Sprintf("took %v, want about %v", elapsed, want))
+
+	// Closing the server interrupts paced writes.
+	slow, err := memhttp.New(handler, memhttp.WithoutTLS(), memhttp.WithBandwidth(1024))
+	attest.Ok(t, err, attest.Fatal())
+	errs := make(chan error, 1)
+	go func() {
+		res, err := slow.Client().Get(slow.URL())
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	attest.Ok(t, slow.Close())
+	attest.Error(t, <-errs)
+	attest.True(t, time.Since(start) < time.Second, attest.Sprintf("Close took %v", time.Since(start)))
+}
+
+func TestChunkedDelivery(t *testing.T) {
+	t.Parallel()
+	const maxChunk = 7
+	payload := bytes.Repeat([]byte("0123456789"), 10_000)
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(payload)
+			})
+			opts := append([]memhttp.Option{memhttp.WithChunkedDelivery(maxChunk)}, tt.opts...)
+			srv := memhttptest.New(t, handler, opts...)
+			transport := srv.Transport()
+			var reads readSizes
+			dial := transport.DialContext
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &readSizeConn{Conn: conn, sizes: &reads}, nil
+			}
+			res, err := (&http.Client{Transport: transport}).Get(srv.URL())
+			attest.Ok(t, err, attest.Fatal())
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			attest.Ok(t, err)
+			attest.Equal(t, body, payload)
+			count, largest := reads.get()
+			attest.True(t, count > len(payload)/maxChunk, attest.Sprintf("only %d reads", count))
+			attest.Equal(t, largest, maxChunk)
+		})
+	}
+}
+
+// readSizes records the number and maximum size of reads from a connection.
+type readSizes struct {
+	mu      sync.Mutex
+	count   int
+	largest int
+}
+
+func (r *readSizes) get() (count, largest int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count, r.largest
+}
+
+type readSizeConn struct {
+	net.Conn
+
+	sizes *readSizes
+}
+
+func (c *readSizeConn) Read(bs []byte) (int, error) {
+	n, err := c.Conn.Read(bs)
+	c.sizes.mu.Lock()
+	c.sizes.count++
+	if n > c.sizes.largest {
+		c.sizes.largest = n
+	}
+	c.sizes.mu.Unlock()
+	return n, err
+}
+
+func TestClientPool(t *testing.T) {
+	t.Parallel()
+	var (
+		mu      sync.Mutex
+		active  = make(map[net.Conn]int)
+		maxOpen int
+	)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := memhttp.ConnFromContext(r.Context())
+		mu.Lock()
+		active[conn]++
+		if len(active) > maxOpen {
+			maxOpen = len(active)
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		if active[conn]--; active[conn] == 0 {
+			delete(active, conn)
+		}
+		mu.Unlock()
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithoutHTTP2(), memhttp.WithClientPool(10, 10, 2))
+	client, dials := countingClient(srv)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(srv.URL())
+			if !attest.Ok(t, err) {
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	attest.True(t, dials() <= 2, attest.Sprintf("dialed %d connections", dials()))
+	mu.Lock()
+	defer mu.Unlock()
+	attest.True(t, maxOpen <= 2, attest.Sprintf("used %d connections at once", maxOpen))
+}
+
+func TestRetryingClient(t *testing.T) {
+	t.Parallel()
+	// Dials fail while the server is paused, until we resume it.
+	srv := memhttptest.New(t, &greeter{}, memhttp.WithDialTimeout(10*time.Millisecond))
+	srv.Pause()
+	_, err := srv.Client().Get(srv.URL())
+	attest.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = srv.RetryingClient(100).Post(srv.URL(), "text/plain", strings.NewReader("not idempotent"))
+	attest.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	time.AfterFunc(50*time.Millisecond, srv.Resume)
+	client := srv.RetryingClient(500)
+	res, err := client.Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, string(body), greeting)
+
+	// Certificate errors and ended contexts aren't retried.
+	expired := memhttptest.New(t, &greeter{}, memhttp.WithCertificateValidity(
+		time.Now().Add(-2*time.Hour),
+		time.Now().Add(-time.Hour),
+	))
+	_, err = expired.RetryingClient(5).Get(expired.URL())
+	var certErr *tls.CertificateVerificationError
+	attest.True(t, errors.As(err, &certErr), attest.Sprintf("got %v", err))
+	attest.Equal(t, expired.Stats().TotalConns, 1)
+	srv.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL(), nil)
+	attest.Ok(t, err, attest.Fatal())
+	start := time.Now()
+	_, err = srv.RetryingClient(1000).Do(req)
+	attest.ErrorIs(t, err, context.DeadlineExceeded)
+	attest.True(t, time.Since(start) < time.Second, attest.Sprintf("took %v", time.Since(start)))
+}
+
+func TestHTTP2FlowControl(t *testing.T) {
+	t.Parallel()
+	const window, chunk, chunks = 1024, 1024, 16
+	var flushed atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			w.Write(bytes.Repeat([]byte{'a'}, chunk))
+			w.(http.Flusher).Flush()
+			flushed.Add(1)
+		}
+	})
+	srv := memhttptest.New(t, handler, memhttp.WithHTTP2FlowControl(0, window))
+	res, err := srv.Client().Get(srv.URL())
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	attest.Equal(t, res.ProtoMajor, 2)
+	// Until the client reads, the handler can't flush more than the client's
+	// stream window.
+	time.Sleep(50 * time.Millisecond)
+	attest.True(t, flushed.Load() <= window/chunk, attest.Sprintf("flushed %d chunks", flushed.Load()))
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, len(body), chunk*chunks)
+	attest.Equal(t, flushed.Load(), chunks)
+}
+
+func TestClients(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "user", Value: r.URL.Query().Get("user")})
+	})
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("user"); err == nil {
+			io.WriteString(w, c.Value)
+		}
+	})
+	srv := memhttptest.New(t, mux)
+	clients := srv.Clients(3)
+	attest.Equal(t, len(clients), 3, attest.Fatal())
+	get := func(client *http.Client, path string) string {
+		res, err := client.Get(srv.URL() + path)
+		attest.Ok(t, err, attest.Fatal())
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		return string(body)
+	}
+	get(clients[0], "/login?user=alice")
+	get(clients[1], "/login?user=bob")
+	attest.Equal(t, get(clients[0], "/whoami"), "alice")
+	attest.Equal(t, get(clients[1], "/whoami"), "bob")
+	attest.Equal(t, get(clients[2], "/whoami"), "")
+}
+
+func TestCloseUnblocksAccept(t *testing.T) {
+	t.Parallel()
+	srv, err := memhttp.New(&greeter{})
+	attest.Ok(t, err, attest.Fatal())
+	// With no clients, the server's accept loop is blocked.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- srv.Close()
+	}()
 	select {
-	case <-done:
-	case <-time.After(5 * time.Second):
-		t.Error("OnShutdown hook didn't fire")
+	case err := <-closed:
+		attest.Ok(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't return promptly")
+	}
+	_, err = srv.Client().Get(srv.URL())
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "listener closed")
+	attest.ErrorIs(t, err, net.ErrClosed)
+	_, err = srv.Transport().DialContext(context.Background(), "tcp", srv.Addr().String()+":443")
+	attest.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestRequestHeaders(t *testing.T) {
+	t.Parallel()
+	for _, tt := range protocols {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			opts := append([]memhttp.Option{
+				memhttp.WithRequestID("X-Request-Id"),
+				memhttp.WithHeaderCapture(),
+			}, tt.opts...)
+			srv := memhttptest.New(t, &greeter{}, opts...)
+			attest.Zero(t, srv.LastRequestHeaders())
+			req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+			attest.Ok(t, err)
+			req.Header.Set("X-Request-Id", "abc")
+			req.Header["x-lowercase"] = []string{"raw"}
+			req.Header.Add("X-Multi", "one")
+			req.Header.Add("X-Multi", "two")
+			res, err := srv.Client().Do(req)
+			attest.Ok(t, err, attest.Fatal())
+			res.Body.Close()
+
+			got, ok := srv.RequestHeaders("abc")
+			attest.True(t, ok, attest.Fatal())
+			attest.Equal(t, got.Values("X-Multi"), []string{"one", "two"})
+			attest.Equal(t, got.Get("X-Lowercase"), "raw")
+			attest.Equal(t, srv.LastRequestHeaders(), got)
+			_, ok = srv.RequestHeaders("unknown")
+			attest.False(t, ok)
+		})
+	}
+	t.Run("evict", func(t *testing.T) {
+		t.Parallel()
+		srv := memhttptest.New(t, &greeter{}, memhttp.WithRequestID("X-Request-Id"), memhttp.WithHeaderCapture())
+		client := srv.Client()
+		for i := range 1001 {
+			req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+			attest.Ok(t, err, attest.Fatal())
+			req.Header.Set("X-Request-Id", strconv.Itoa(i))
+			res, err := client.Do(req)
+			attest.Ok(t, err, attest.Fatal())
+			res.Body.Close()
+		}
+		_, ok := srv.RequestHeaders("0")
+		attest.False(t, ok, attest.Sprintf("oldest headers retained"))
+		_, ok = srv.RequestHeaders("1000")
+		attest.True(t, ok)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		srv := memhttptest.New(t, &greeter{}, memhttp.WithRequestID("X-Request-Id"))
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		attest.Zero(t, srv.LastRequestHeaders())
+		_, ok := srv.RequestHeaders(res.Header.Get("X-Request-Id"))
+		attest.False(t, ok)
+	})
+}
+
+func TestEstimatedRequestBytes(t *testing.T) {
+	t.Parallel()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	srv := memhttptest.New(t, echo, memhttp.WithRequestID("X-Request-Id"))
+	send := func(body string) (int64, int64) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL(), strings.NewReader(body))
+		attest.Ok(t, err, attest.Fatal())
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := srv.Client().Do(req)
+		attest.Ok(t, err, attest.Fatal())
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		reqBytes, resBytes, ok := srv.EstimatedRequestBytes(res.Header.Get("X-Request-Id"))
+		attest.True(t, ok, attest.Fatal())
+		return reqBytes, resBytes
+	}
+	reqSmall, resSmall := send("hi")
+	reqLarge, resLarge := send(strings.Repeat("a", 1002))
+	// Headers are counted, so totals exceed the body size.
+	attest.True(t, reqSmall > 2)
+	attest.True(t, resSmall > 2)
+	// Otherwise identical exchanges differ only by their body sizes. Request
+	// Content-Length grows from 1 to 4 digits.
+	attest.Equal(t, reqLarge-reqSmall, 1000+3)
+	attest.Equal(t, resLarge-resSmall, 1000)
+
+	_, _, ok := srv.EstimatedRequestBytes("unknown")
+	attest.False(t, ok)
+	plain := memhttptest.New(t, echo)
+	_, _, ok = plain.EstimatedRequestBytes("unknown")
+	attest.False(t, ok)
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		opts []memhttp.Option
+	}{
+		{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
+		{"request_id", []memhttp.Option{memhttp.WithoutHTTP2(), memhttp.WithRequestID("X-Request-Id")}},
+		{"har", []memhttp.Option{memhttp.WithoutHTTP2(), memhttp.WithHARCapture()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tunnel := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodConnect {
+					http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+					return
+				}
+				conn, rw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				// Echo tunneled bytes until the client closes the tunnel.
+				io.Copy(conn, rw)
+			})
+			srv := memhttptest.New(t, tunnel, tt.opts...)
+			transport := srv.Transport()
+			conn, err := transport.DialContext(context.Background(), "tcp", "example.com:443")
+			attest.Ok(t, err, attest.Fatal())
+			if transport.TLSClientConfig != nil {
+				cfg := transport.TLSClientConfig.Clone()
+				cfg.ServerName = "example.com"
+				conn = tls.Client(conn, cfg)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "CONNECT upstream.test:443 HTTP/1.1\r\nHost: upstream.test:443\r\n\r\n")
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			attest.Ok(t, err, attest.Fatal())
+			attest.Equal(t, res.StatusCode, http.StatusOK)
+			for _, msg := range []string{"ping\n", "pong\n"} {
+				_, err := io.WriteString(conn, msg)
+				attest.Ok(t, err, attest.Fatal())
+				got, err := br.ReadString('\n')
+				attest.Ok(t, err, attest.Fatal())
+				attest.Equal(t, got, msg)
+			}
+		})
+	}
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	t.Parallel()
+	const (
+		chunk  = 1 << 20
+		chunks = 8
+	)
+	for _, tt := range protocols {
+		// With HTTP/2, wait for the handler to acknowledge each chunk before
+		// sending the next. HTTP/1 handlers can't respond until they've
+		// finished reading the request body.
+		interleave := tt.name == "http2"
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				buf := make([]byte, 1024)
+				var total int
+				for {
+					n, err := r.Body.Read(buf)
+					total += n
+					if interleave && n > 0 && total%chunk == 0 {
+						fmt.Fprintln(w, total)
+						w.(http.Flusher).Flush()
+					}
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				fmt.Fprintln(w, "total", total)
+			})
+			srv := memhttptest.New(t, handler, tt.opts...)
+			pr, pw := io.Pipe()
+			req, err := http.NewRequest(http.MethodPost, srv.URL(), pr)
+			attest.Ok(t, err, attest.Fatal())
+			acks := make(chan struct{})
+			go func() {
+				payload := bytes.Repeat([]byte{'a'}, chunk)
+				for i := 0; i < chunks; i++ {
+					if _, err := pw.Write(payload); err != nil {
+						return
+					}
+					if interleave {
+						<-acks
+					}
+				}
+				pw.Close()
+			}()
+			res, err := srv.Client().Do(req)
+			attest.Ok(t, err, attest.Fatal())
+			defer res.Body.Close()
+			lines := bufio.NewScanner(res.Body)
+			if interleave {
+				for i := 1; i <= chunks; i++ {
+					attest.True(t, lines.Scan(), attest.Fatal())
+					attest.Equal(t, lines.Text(), fmt.Sprint(i*chunk))
+					acks <- struct{}{}
+				}
+			}
+			attest.True(t, lines.Scan(), attest.Fatal())
+			attest.Equal(t, lines.Text(), fmt.Sprintf("total %d", chunk*chunks))
+		})
+	}
+}
+
+func TestEmptyBodies(t *testing.T) {
+	t.Parallel()
+	count := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, len(body))
+	})
+	bodies := []struct {
+		name string
+		body func() io.Reader
+	}{
+		{"nil", func() io.Reader { return nil }},
+		{"empty", func() io.Reader { return strings.NewReader("") }},
+		{"nobody", func() io.Reader { return http.NoBody }},
 	}
+	memhttptest.EachProtocol(t, count, func(t *testing.T, srv *memhttp.Server) {
+		t.Parallel()
+		client := srv.Client()
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			for _, body := range bodies {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				req, err := http.NewRequestWithContext(ctx, method, srv.URL(), body.body())
+				attest.Ok(t, err)
+				res, err := client.Do(req)
+				attest.Ok(t, err, attest.Sprintf("%s with %s body", method, body.name))
+				if err == nil {
+					got, err := io.ReadAll(res.Body)
+					attest.Ok(t, err)
+					res.Body.Close()
+					attest.Equal(t, res.StatusCode, http.StatusOK)
+					attest.Equal(t, string(got), "0", attest.Sprintf("%s with %s body", method, body.name))
+				}
+				cancel()
+			}
+		}
+	})
+}
+
+func TestHead(t *testing.T) {
+	t.Parallel()
+	memhttptest.EachProtocol(t, &greeter{}, func(t *testing.T, srv *memhttp.Server) {
+		t.Parallel()
+		client := srv.Client()
+		res, err := client.Head(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, res.StatusCode, http.StatusOK)
+		attest.Equal(t, res.Header.Get("Content-Length"), fmt.Sprint(len(greeting)))
+		attest.Equal(t, res.Header.Get("Content-Type"), "text/plain; charset=utf-8")
+		attest.Zero(t, len(body))
+
+		// If any body bytes leaked onto the connection, they'd corrupt the
+		// next response.
+		res, err = client.Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		body, err = io.ReadAll(res.Body)
+		attest.Ok(t, err)
+		res.Body.Close()
+		attest.Equal(t, string(body), greeting)
+	})
 }
 
 func Example() {
@@ -157,3 +3188,121 @@ func ExampleServer_Shutdown() {
 		panic(err)
 	}
 }
+
+// fakeClock is a memhttp.Clock that only moves when advanced.
+// protocols are the protocols memhttp serves, with the options that select
+// them. Tests that need more control over each server than
+// memhttptest.EachProtocol offers range over it.
+var protocols = []struct {
+	name string
+	opts []memhttp.Option
+}{
+	{"http2", nil},
+	{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
+	{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}},
+}
+
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// countingClient returns a client for the server and a function reporting how
+// many connections the client has dialed.
+func countingClient(srv *memhttp.Server) (*http.Client, func() int) {
+	client := srv.Client()
+	return client, countDials(client)
+}
+
+// notifyClose instruments the client's transport, returning a channel that
+// receives once for each connection the client closes. Clients stop reusing
+// connections before closing them.
+func notifyClose(client *http.Client) <-chan struct{} {
+	closed := make(chan struct{}, 16)
+	transport := client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &closeNotifyingConn{Conn: conn, closed: closed}, nil
+	}
+	return closed
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+
+	once   sync.Once
+	closed chan<- struct{}
+}
+
+func (c *closeNotifyingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.closed <- struct{}{} })
+	return err
+}
+
+// countDials instruments the client's transport, returning a function that
+// reports how many connections it has dialed.
+func countDials(client *http.Client) func() int {
+	var mu sync.Mutex
+	var dials int
+	transport := client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		return dial(ctx, network, addr)
+	}
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials
+	}
+}
@@ -0,0 +1,45 @@
+package memhttptest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// MustCompleteWithin calls f and fails the test if f returns an error or
+// doesn't return within d. On timeout, the failure includes the stacks of all
+// running goroutines, which usually show where the request is stuck. Since f
+// can't be interrupted, it keeps running in the background after a timeout.
+//
+// Like other functions that call tb.Fatalf, MustCompleteWithin must be called
+// from the goroutine running the test.
+func MustCompleteWithin(tb testing.TB, d time.Duration, f func() error) {
+	tb.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			tb.Fatalf("call failed: %v", err)
+		}
+	case <-timer.C:
+		tb.Fatalf("call didn't complete within %v\n\ngoroutines:\n%s", d, stacks())
+	}
+}
+
+// stacks returns the stacks of all goroutines, growing its buffer until they
+// fit.
+func stacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true /* all */)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,37 @@
+package memhttptest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// snippetLen limits the amount of a response body included in failure
+// messages.
+const snippetLen = 512
+
+// DecodeJSON checks that res has a 2xx status, decodes its JSON body into v,
+// and closes the body. Any errors fail the test, with failure messages that
+// include the response status and the beginning of the body.
+func DecodeJSON(tb testing.TB, res *http.Response, v any) {
+	tb.Helper()
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		tb.Fatalf("read response body (status %q): %v", res.Status, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		tb.Fatalf("unexpected status %q, body: %s", res.Status, snippet(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		tb.Fatalf("decode JSON response (status %q): %v, body: %s", res.Status, err, snippet(body))
+	}
+}
+
+func snippet(body []byte) string {
+	if len(body) <= snippetLen {
+		return string(body)
+	}
+	return string(body[:snippetLen]) + "..."
+}
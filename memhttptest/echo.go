@@ -0,0 +1,39 @@
+package memhttptest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Echo describes a request. It's the JSON document written by EchoHandler.
+type Echo struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// EchoHandler returns a handler that reflects each request back to the client
+// as a JSON-encoded Echo. It's a convenient fixture for testing clients,
+// proxies, and middleware.
+func EchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Echo{
+			Method: r.Method,
+			URL:    r.URL.String(),
+			Proto:  r.Proto,
+			Host:   r.Host,
+			Header: r.Header,
+			Body:   string(body),
+		})
+	})
+}
@@ -0,0 +1,35 @@
+package memhttptest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.akshayshah.org/memhttp"
+)
+
+// ExpectNoRequests fails the test if srv receives any requests between the
+// call to ExpectNoRequests and the end of the test. It's useful in negative
+// tests, where a client should never reach the server (for example, because
+// it's serving responses from a cache).
+func ExpectNoRequests(tb testing.TB, srv *memhttp.Server) {
+	tb.Helper()
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	unregister := srv.OnRequest(func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Method+" "+r.URL.String())
+	})
+	tb.Cleanup(func() {
+		unregister()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(received) > 0 {
+			tb.Errorf("expected no requests, got %d:\n%s", len(received), strings.Join(received, "\n"))
+		}
+	})
+}
@@ -0,0 +1,16 @@
+package memhttptest
+
+import (
+	"io/fs"
+	"net/http"
+)
+
+// FileServer returns a handler that serves files from fsys, like
+// [http.FileServerFS]. Content types are detected from file extensions (or,
+// failing that, from the files' contents), and range and conditional
+// requests are supported. It's a convenient fixture for testing clients that
+// download static assets; with [testing/fstest.MapFS], files can be defined
+// inline.
+func FileServer(fsys fs.FS) http.Handler {
+	return http.FileServerFS(fsys)
+}
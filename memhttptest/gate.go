@@ -0,0 +1,35 @@
+package memhttptest
+
+import (
+	"net/http"
+	"sync"
+
+	"go.akshayshah.org/memhttp"
+)
+
+// GatedHandler returns a handler whose responses are held until release is
+// called, so tests can control exactly when responses are sent. Requests block
+// in the handler until then; afterwards, they're answered immediately with
+// 200 OK and an empty body. Calling release more than once is safe.
+//
+// Gated requests don't block shutdown: if the request's context ends or the
+// server begins to shut down first, the handler gives up and responds with
+// 503 Service Unavailable.
+func GatedHandler() (h http.Handler, release func()) {
+	gate := make(chan struct{})
+	var once sync.Once
+	release = func() {
+		once.Do(func() { close(gate) })
+	}
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-gate:
+			w.WriteHeader(http.StatusOK)
+		case <-memhttp.ShuttingDown(r.Context()):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	return h, release
+}
@@ -5,6 +5,8 @@ package memhttptest
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"go.akshayshah.org/memhttp"
@@ -37,6 +39,63 @@ func New(tb testing.TB, h http.Handler, opts ...memhttp.Option) *memhttp.Server
 	return s
 }
 
+// NewBenchmark is like New, but tailored to benchmarks: it also reports
+// allocations and resets the benchmark timer, so that starting the server
+// isn't measured.
+func NewBenchmark(b *testing.B, h http.Handler, opts ...memhttp.Option) *memhttp.Server {
+	b.Helper()
+	s := New(b, h, opts...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	return s
+}
+
+// exchangeHeader correlates client requests with the requests observed by the
+// server.
+const exchangeHeader = "Memhttptest-Exchange-Id"
+
+var exchangeID atomic.Uint64
+
+// Exchange sends req using the server's client, and returns both the client's
+// response and the request as received by the server (after net/http has
+// parsed it). By the time Exchange returns, the handler may have consumed the
+// server-side request's body. Each exchange uses a new connection, which
+// closes once the caller closes the response body.
+//
+// Exchange is safe to call concurrently, including from goroutines other than
+// the one running the test: it reports errors with tb.Errorf and returns nil
+// results, rather than stopping the test.
+func Exchange(tb testing.TB, srv *memhttp.Server, req *http.Request) (*http.Response, *http.Request) {
+	tb.Helper()
+	id := strconv.FormatUint(exchangeID.Add(1), 10)
+	received := make(chan *http.Request, 1)
+	unregister := srv.OnRequest(func(r *http.Request) {
+		if r.Header.Get(exchangeHeader) != id {
+			return
+		}
+		r.Header.Del(exchangeHeader)
+		received <- r.Clone(r.Context())
+	})
+	defer unregister()
+	req = req.Clone(req.Context())
+	req.Header.Set(exchangeHeader, id)
+	transport := srv.Transport()
+	transport.DisableKeepAlives = true
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		tb.Errorf("send request: %v", err)
+		return nil, nil
+	}
+	select {
+	case r := <-received:
+		return res, r
+	default:
+		res.Body.Close()
+		tb.Errorf("server didn't receive request %s %s", req.Method, req.URL)
+		return nil, nil
+	}
+}
+
 type tbWriter struct {
 	tb testing.TB
 }
@@ -0,0 +1,397 @@
+package memhttptest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.akshayshah.org/attest"
+	"go.akshayshah.org/memhttp"
+	"go.akshayshah.org/memhttp/memhttptest"
+)
+
+func TestExchange(t *testing.T) {
+	t.Parallel()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	srv := memhttptest.New(t, echo, memhttp.WithHeaderCapture())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("request %d", i)
+			req, err := http.NewRequest(http.MethodPost, srv.URL()+"/echo", strings.NewReader(body))
+			attest.Ok(t, err)
+			req.Header.Set("X-Request", body)
+			res, received := memhttptest.Exchange(t, srv, req)
+			if res == nil {
+				return
+			}
+			defer res.Body.Close()
+			got, err := io.ReadAll(res.Body)
+			attest.Ok(t, err)
+			attest.Equal(t, string(got), body)
+			attest.Equal(t, received.Method, http.MethodPost)
+			attest.Equal(t, received.URL.Path, "/echo")
+			attest.Equal(t, received.Header.Get("X-Request"), body)
+			attest.Zero(t, received.Header.Get("Memhttptest-Exchange-Id"))
+			attest.Zero(t, srv.LastRequestHeaders().Get("Memhttptest-Exchange-Id"))
+		}(i)
+	}
+	wg.Wait()
+
+	// Failures don't stop the calling goroutine.
+	closed, err := memhttp.New(echo)
+	attest.Ok(t, err, attest.Fatal())
+	attest.Ok(t, closed.Close())
+	tb := &recordingTB{TB: t}
+	req, err := http.NewRequest(http.MethodGet, closed.URL(), nil)
+	attest.Ok(t, err, attest.Fatal())
+	res, received := memhttptest.Exchange(tb, closed, req)
+	attest.Zero(t, res)
+	attest.Zero(t, received)
+	attest.Equal(t, len(tb.errors), 1)
+}
+
+func TestEchoHandler(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, memhttptest.EchoHandler())
+	req, err := http.NewRequest(http.MethodPost, srv.URL()+"/path?q=1", strings.NewReader("hello"))
+	attest.Ok(t, err)
+	req.Header.Set("X-Test", "value")
+	res, err := srv.Client().Do(req)
+	attest.Ok(t, err, attest.Fatal())
+	defer res.Body.Close()
+	attest.Equal(t, res.Header.Get("Content-Type"), "application/json")
+	var echo memhttptest.Echo
+	attest.Ok(t, json.NewDecoder(res.Body).Decode(&echo))
+	attest.Equal(t, echo.Method, http.MethodPost)
+	attest.Equal(t, echo.URL, "/path?q=1")
+	attest.Equal(t, echo.Proto, "HTTP/2.0")
+	attest.Equal(t, echo.Host, "example.com")
+	attest.Equal(t, echo.Header.Get("X-Test"), "value")
+	attest.Equal(t, echo.Body, "hello")
+}
+
+func TestStaticHandler(t *testing.T) {
+	t.Parallel()
+	const body = `{"error": "unavailable"}`
+	headers := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Retry-After":  []string{"30"},
+	}
+	srv := memhttptest.New(t, memhttptest.StaticHandler(http.StatusServiceUnavailable, body, headers))
+
+	res, err := srv.Client().Post(srv.URL()+"/any/path", "text/plain", strings.NewReader("ignored"))
+	attest.Ok(t, err)
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, res.StatusCode, http.StatusServiceUnavailable)
+	attest.Equal(t, res.Header.Get("Content-Type"), "application/json")
+	attest.Equal(t, res.Header.Get("Retry-After"), "30")
+	attest.Equal(t, string(got), body)
+
+	res, err = srv.Client().Head(srv.URL())
+	attest.Ok(t, err)
+	defer res.Body.Close()
+	got, err = io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	attest.Equal(t, res.StatusCode, http.StatusServiceUnavailable)
+	attest.Equal(t, res.ContentLength, int64(len(body)))
+	attest.Equal(t, res.Header.Get("Retry-After"), "30")
+	attest.Zero(t, len(got))
+}
+
+func TestDecodeJSON(t *testing.T) {
+	t.Parallel()
+	srv := memhttptest.New(t, memhttptest.EchoHandler())
+	res, err := srv.Client().Post(srv.URL()+"/path", "text/plain", strings.NewReader("hello"))
+	attest.Ok(t, err, attest.Fatal())
+	var echo memhttptest.Echo
+	memhttptest.DecodeJSON(t, res, &echo)
+	attest.Equal(t, echo.URL, "/path")
+	attest.Equal(t, echo.Body, "hello")
+
+	failures := []struct {
+		name   string
+		status int
+		body   string
+		want   []string
+	}{
+		{"status", http.StatusBadRequest, `{"error": "nope"}`, []string{"400 Bad Request", `{"error": "nope"}`}},
+		{"syntax", http.StatusOK, "not json", []string{"200 OK", "not json"}},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := memhttptest.New(t, memhttptest.StaticHandler(tt.status, tt.body, nil))
+			res, err := srv.Client().Get(srv.URL())
+			attest.Ok(t, err, attest.Fatal())
+			tb := &recordingTB{TB: t}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var v map[string]string
+				memhttptest.DecodeJSON(tb, res, &v)
+			}()
+			<-done
+			attest.Equal(t, len(tb.errors), 1, attest.Fatal())
+			for _, want := range tt.want {
+				attest.True(t, strings.Contains(tb.errors[0], want), attest.Sprintf("%q missing %q", tb.errors[0], want))
+			}
+		})
+	}
+}
+
+func TestGatedHandler(t *testing.T) {
+	t.Parallel()
+	t.Run("release", func(t *testing.T) {
+		t.Parallel()
+		h, release := memhttptest.GatedHandler()
+		srv := memhttptest.New(t, h)
+		entered := make(chan struct{}, 2)
+		unregister := srv.OnRequest(func(*http.Request) { entered <- struct{}{} })
+		defer unregister()
+		results := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				res, err := srv.Client().Get(srv.URL())
+				if !attest.Ok(t, err) {
+					results <- 0
+					return
+				}
+				res.Body.Close()
+				results <- res.StatusCode
+			}()
+		}
+		<-entered
+		<-entered
+		select {
+		case code := <-results:
+			t.Fatalf("gated request completed with status %d before release", code)
+		case <-time.After(10 * time.Millisecond):
+		}
+		release()
+		release() // idempotent
+		attest.Equal(t, <-results, http.StatusOK)
+		attest.Equal(t, <-results, http.StatusOK)
+	})
+	t.Run("shutdown", func(t *testing.T) {
+		t.Parallel()
+		h, _ := memhttptest.GatedHandler()
+		srv, err := memhttp.New(h)
+		attest.Ok(t, err)
+		entered := make(chan struct{})
+		srv.OnRequest(func(*http.Request) { close(entered) })
+		results := make(chan int, 1)
+		go func() {
+			res, err := srv.Client().Get(srv.URL())
+			if !attest.Ok(t, err) {
+				results <- 0
+				return
+			}
+			res.Body.Close()
+			results <- res.StatusCode
+		}()
+		<-entered
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		attest.Ok(t, srv.Shutdown(ctx))
+		attest.Equal(t, <-results, http.StatusServiceUnavailable)
+	})
+}
+
+func TestFileServer(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"static/app.css": {Data: []byte("body { color: red; }")},
+		"data.bin":       {Data: []byte("0123456789")},
+	}
+	memhttptest.EachProtocol(t, memhttptest.FileServer(fsys), func(t *testing.T, srv *memhttp.Server) {
+		res, err := srv.Client().Get(srv.URL() + "/static/app.css")
+		attest.Ok(t, err, attest.Fatal())
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		attest.Ok(t, err)
+		attest.Equal(t, res.StatusCode, http.StatusOK)
+		attest.Equal(t, res.Header.Get("Content-Type"), "text/css; charset=utf-8")
+		attest.Equal(t, string(body), "body { color: red; }")
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL()+"/data.bin", nil)
+		attest.Ok(t, err)
+		req.Header.Set("Range", "bytes=2-5")
+		res, err = srv.Client().Do(req)
+		attest.Ok(t, err, attest.Fatal())
+		body, err = io.ReadAll(res.Body)
+		res.Body.Close()
+		attest.Ok(t, err)
+		attest.Equal(t, res.StatusCode, http.StatusPartialContent)
+		attest.Equal(t, res.Header.Get("Content-Range"), "bytes 2-5/10")
+		attest.Equal(t, string(body), "2345")
+	})
+}
+
+func TestMustCompleteWithin(t *testing.T) {
+	t.Parallel()
+	h, release := memhttptest.GatedHandler()
+	srv := memhttptest.New(t, h)
+	get := func() error {
+		res, err := srv.Client().Get(srv.URL())
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	run := func(d time.Duration, f func() error) []string {
+		tb := &recordingTB{TB: t}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			memhttptest.MustCompleteWithin(tb, d, f)
+		}()
+		<-done
+		return tb.errors
+	}
+
+	errs := run(20*time.Millisecond, get)
+	attest.Equal(t, len(errs), 1, attest.Fatal())
+	attest.Subsequence(t, errs[0], "didn't complete within 20ms")
+	// The stuck handler should appear in the goroutine dump.
+	attest.Subsequence(t, errs[0], "memhttptest.GatedHandler")
+
+	release()
+	attest.Zero(t, run(5*time.Second, get))
+	errs = run(5*time.Second, func() error { return errors.New("oops") })
+	attest.Equal(t, errs, []string{"call failed: oops"})
+}
+
+func TestFailOnPanic(t *testing.T) {
+	t.Parallel()
+	tb := &recordingTB{TB: t}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("oh no")
+		}
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+	})
+	srv := memhttptest.New(tb, memhttptest.FailOnPanic(tb, handler))
+	for _, path := range []string{"/ok", "/abort", "/panic"} {
+		res, err := srv.Client().Get(srv.URL() + path)
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+	tb.cleanup()
+	attest.Equal(t, len(tb.errors), 1, attest.Fatal())
+	attest.Subsequence(t, tb.errors[0], "GET /panic")
+	attest.Subsequence(t, tb.errors[0], "oh no")
+}
+
+func TestExpectNoRequests(t *testing.T) {
+	t.Parallel()
+	t.Run("none", func(t *testing.T) {
+		t.Parallel()
+		tb := &recordingTB{TB: t}
+		srv := memhttptest.New(tb, memhttptest.EchoHandler())
+		memhttptest.ExpectNoRequests(tb, srv)
+		tb.cleanup()
+		attest.Zero(t, tb.errors)
+	})
+	t.Run("some", func(t *testing.T) {
+		t.Parallel()
+		tb := &recordingTB{TB: t}
+		srv := memhttptest.New(tb, memhttptest.EchoHandler())
+		memhttptest.ExpectNoRequests(tb, srv)
+		res, err := srv.Client().Get(srv.URL() + "/cached")
+		attest.Ok(t, err, attest.Fatal())
+		res.Body.Close()
+		tb.cleanup()
+		attest.Equal(t, len(tb.errors), 1, attest.Fatal())
+		attest.Subsequence(t, tb.errors[0], "GET /cached")
+	})
+}
+
+func TestEachProtocol(t *testing.T) {
+	t.Parallel()
+	var (
+		mu     sync.Mutex
+		protos []string
+	)
+	memhttptest.EachProtocol(t, memhttptest.EchoHandler(), func(t *testing.T, srv *memhttp.Server) {
+		res, err := srv.Client().Get(srv.URL())
+		attest.Ok(t, err, attest.Fatal())
+		defer res.Body.Close()
+		var echo memhttptest.Echo
+		attest.Ok(t, json.NewDecoder(res.Body).Decode(&echo))
+		proto := echo.Proto
+		if res.TLS == nil {
+			proto += " plaintext"
+		}
+		mu.Lock()
+		protos = append(protos, t.Name()+": "+proto)
+		mu.Unlock()
+	})
+	attest.Equal(t, protos, []string{
+		"TestEachProtocol/http2: HTTP/2.0",
+		"TestEachProtocol/http1: HTTP/1.1",
+		"TestEachProtocol/plaintext: HTTP/1.1 plaintext",
+	})
+}
+
+// recordingTB records errors and cleanup functions rather than passing them
+// to the underlying testing.TB.
+type recordingTB struct {
+	testing.TB
+
+	mu       sync.Mutex
+	errors   []string
+	cleanups []func()
+}
+
+func (tb *recordingTB) Error(args ...any) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.errors = append(tb.errors, fmt.Sprint(args...))
+}
+
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.Error(fmt.Sprintf(format, args...))
+}
+
+// Fatalf records the error and stops the calling goroutine, like
+// testing.TB.Fatalf. Callers must run the code under test on a separate
+// goroutine.
+func (tb *recordingTB) Fatalf(format string, args ...any) {
+	tb.Error(fmt.Sprintf(format, args...))
+	runtime.Goexit()
+}
+
+func (tb *recordingTB) Cleanup(f func()) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.cleanups = append(tb.cleanups, f)
+}
+
+func (tb *recordingTB) cleanup() {
+	tb.mu.Lock()
+	cleanups := tb.cleanups
+	tb.cleanups = nil
+	tb.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
@@ -0,0 +1,53 @@
+package memhttptest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"testing"
+)
+
+// FailOnPanic wraps h so that handler panics fail the test. By default,
+// net/http recovers panics and logs them, so a test that doesn't carefully
+// check responses may pass despite a buggy handler.
+//
+// FailOnPanic records each panic (along with its stack trace) and re-panics,
+// so clients see the same reset connection or stream as usual. The recorded
+// panics are reported via tb.Error when the test completes. Panics with
+// [http.ErrAbortHandler], which deliberately abort a response, are ignored.
+//
+// Typically, FailOnPanic is used when constructing a server:
+//
+//	srv := memhttptest.New(t, memhttptest.FailOnPanic(t, handler))
+func FailOnPanic(tb testing.TB, h http.Handler) http.Handler {
+	tb.Helper()
+	var (
+		mu     sync.Mutex
+		panics []string
+	)
+	tb.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range panics {
+			tb.Error(p)
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); !ok || !errors.Is(err, http.ErrAbortHandler) {
+				msg := fmt.Sprintf("handler panicked serving %s %s: %v\n%s", r.Method, r.URL, v, debug.Stack())
+				mu.Lock()
+				panics = append(panics, msg)
+				mu.Unlock()
+			}
+			panic(v)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package memhttptest
+
+import (
+	"net/http"
+	"testing"
+
+	"go.akshayshah.org/memhttp"
+)
+
+// EachProtocol runs f once for each protocol memhttp supports, each time in a
+// subtest with a fresh server constructed by New. The subtests are named
+// "http2" (HTTP/2 over TLS, the default), "http1" (HTTP/1.1 over TLS), and
+// "plaintext" (HTTP/1.1 without TLS). Any options apply to every server.
+//
+// Subtests run serially unless f calls t.Parallel.
+func EachProtocol(t *testing.T, h http.Handler, f func(*testing.T, *memhttp.Server), opts ...memhttp.Option) {
+	t.Helper()
+	protocols := []struct {
+		name string
+		opts []memhttp.Option
+	}{
+		{"http2", nil},
+		{"http1", []memhttp.Option{memhttp.WithoutHTTP2()}},
+		{"plaintext", []memhttp.Option{memhttp.WithoutTLS()}},
+	}
+	for _, p := range protocols {
+		t.Run(p.name, func(t *testing.T) {
+			srv := New(t, h, memhttp.WithOptions(opts...), memhttp.WithOptions(p.opts...))
+			f(t, srv)
+		})
+	}
+}
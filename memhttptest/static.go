@@ -0,0 +1,30 @@
+package memhttptest
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// StaticHandler returns a handler that responds to every request with the
+// given status, headers, and body, regardless of the request. It's a
+// convenient stub for dependencies, especially when testing error paths.
+//
+// Responses to HEAD requests have the same status and headers, including
+// Content-Length, but no body.
+func StaticHandler(status int, body string, headers http.Header) http.Handler {
+	headers = headers.Clone()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for key, values := range headers {
+			h[key] = append([]string(nil), values...)
+		}
+		if _, ok := h["Content-Length"]; !ok {
+			h.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, body)
+		}
+	})
+}
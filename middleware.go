@@ -0,0 +1,264 @@
+package memhttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID assigned to a request by WithRequestID.
+// It's most useful in handlers, which can call it with the request's context.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func withRequestID(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(header, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	var bs [16]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(bs[:])
+}
+
+// withBodyLimits wraps request bodies with http.MaxBytesReader, using the
+// limit with the longest matching path prefix. Requests that don't match any
+// prefix are unlimited.
+func withBodyLimits(limits map[string]int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit, ok := longestPrefix(limits, r.URL.Path); ok && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withPathLatency delays requests by the latency with the longest matching
+// path prefix. If the request ends while it's delayed, the handler isn't
+// called.
+func withPathLatency(clock Clock, latencies map[string]time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, ok := longestPrefix(latencies, r.URL.Path); ok && d > 0 {
+			select {
+			case <-clock.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// longestPrefix returns the value in m whose key is the longest prefix of
+// path.
+func longestPrefix[V any](m map[string]V, path string) (V, bool) {
+	var (
+		match string
+		value V
+		found bool
+	)
+	for prefix, v := range m {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(match)) {
+			match, value, found = prefix, v, true
+		}
+	}
+	return value, found
+}
+
+// withResponseHeaders adds defaults to every response, unless the handler has
+// set the same header.
+func withResponseHeaders(defaults http.Header, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{
+			ResponseWriter: w,
+			beforeHeader: func(h http.Header) {
+				for key, values := range defaults {
+					if _, ok := h[key]; !ok {
+						h[key] = append([]string(nil), values...)
+					}
+				}
+			},
+		}
+		next.ServeHTTP(hw, r)
+		hw.commit()
+	})
+}
+
+// withDate sets the Date header of every response to the current time, as
+// reported by clock, plus skew. Handlers may still set Date themselves.
+func withDate(clock Clock, skew time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{
+			ResponseWriter: w,
+			beforeHeader: func(h http.Header) {
+				if _, ok := h["Date"]; !ok {
+					h.Set("Date", clock.Now().Add(skew).UTC().Format(http.TimeFormat))
+				}
+			},
+		}
+		next.ServeHTTP(hw, r)
+		hw.commit()
+	})
+}
+
+// withServerTiming reports the time the handler took to start its response in
+// a Server-Timing header. If the handler returns without writing anything,
+// the header reports the handler's total duration.
+func withServerTiming(clock Clock, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := clock.Now()
+		hw := &headerWriter{
+			ResponseWriter: w,
+			beforeHeader: func(h http.Header) {
+				ms := float64(clock.Now().Sub(start)) / float64(time.Millisecond)
+				h.Add("Server-Timing", fmt.Sprintf("handler;dur=%.3f", ms))
+			},
+		}
+		next.ServeHTTP(hw, r)
+		hw.commit()
+	})
+}
+
+// withStartupDelay answers requests with 503 Service Unavailable until ready.
+// If block is true, it instead holds requests until ready, and only responds
+// with 503 if the request ends or the server shuts down first.
+func withStartupDelay(clock Clock, ready time.Time, block bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := ready.Sub(clock.Now())
+		if wait <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if block {
+			select {
+			case <-clock.After(wait):
+				next.ServeHTTP(w, r)
+				return
+			case <-ShuttingDown(r.Context()):
+			case <-r.Context().Done():
+			}
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "server is starting up", http.StatusServiceUnavailable)
+	})
+}
+
+// headerWriter is an http.ResponseWriter that calls beforeHeader exactly once,
+// just before the response headers are committed. It lets middleware adjust
+// headers lazily, after the wrapped handler has had a chance to set them.
+type headerWriter struct {
+	http.ResponseWriter
+
+	beforeHeader func(http.Header)
+	wroteHeader  bool
+}
+
+func (w *headerWriter) commit() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.beforeHeader(w.Header())
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.commit()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(bs []byte) (int, error) {
+	w.commit()
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *headerWriter) Flush() {
+	w.commit()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withForceChunked strips Content-Length from responses and flushes after the
+// first write, so that net/http can't compute a length either.
+func withForceChunked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&chunkedWriter{headerWriter: headerWriter{
+			ResponseWriter: w,
+			beforeHeader: func(h http.Header) {
+				h.Del("Content-Length")
+			},
+		}}, r)
+	})
+}
+
+type chunkedWriter struct {
+	headerWriter
+
+	flushed bool
+}
+
+func (w *chunkedWriter) Write(bs []byte) (int, error) {
+	n, err := w.headerWriter.Write(bs)
+	if !w.flushed {
+		w.flushed = true
+		w.Flush()
+	}
+	return n, err
+}
+
+// swappableHandler lets SwapHandler replace the innermost handler while the
+// server is running. Each request loads the current handler exactly once.
+type swappableHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+func newSwappableHandler(h http.Handler) *swappableHandler {
+	s := &swappableHandler{}
+	s.current.Store(&h)
+	return s
+}
+
+func (s *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.current.Load()).ServeHTTP(w, r)
+}
+
+func (s *swappableHandler) swap(h http.Handler) http.Handler {
+	return *s.current.Swap(&h)
+}
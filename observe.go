@@ -0,0 +1,179 @@
+package memhttp
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// OnRequest registers a function to call with each request the server
+// receives, before the request reaches the handler. It returns a function
+// that unregisters f.
+//
+// Functions run synchronously on the handler's goroutine, in the order they
+// were registered, so they should return quickly. They must not read the
+// request body.
+func (s *Server) OnRequest(f func(*http.Request)) (unregister func()) {
+	return s.observers.add(f)
+}
+
+// HandleOrder returns the IDs of the requests the server has received, in the
+// order their handlers started. IDs are assigned by WithRequestID; if the
+// server wasn't constructed with that option, HandleOrder returns nil. Only
+// the most recent 1,000 IDs are retained.
+func (s *Server) HandleOrder() []string {
+	if s.order == nil {
+		return nil
+	}
+	s.order.mu.Lock()
+	defer s.order.mu.Unlock()
+	ids := make([]string, len(s.order.ids))
+	copy(ids, s.order.ids)
+	return ids
+}
+
+// LastRequestHeaders returns a copy of the headers of the most recent request
+// the server received, exactly as net/http parsed them. It returns nil if the
+// server wasn't constructed WithHeaderCapture or hasn't received any requests.
+// It's useful for debugging differences in
+// header handling between HTTP/1.1 and HTTP/2. When requests are concurrent,
+// "most recent" is the request whose handler started last; tests sending
+// requests in parallel should use RequestHeaders instead.
+func (s *Server) LastRequestHeaders() http.Header {
+	if s.headers == nil {
+		return nil
+	}
+	s.headers.mu.Lock()
+	defer s.headers.mu.Unlock()
+	return s.headers.last.Clone()
+}
+
+// RequestHeaders returns a copy of the headers of the request with the given
+// ID (assigned by WithRequestID), exactly as net/http parsed them. It reports
+// false if the server wasn't constructed WithHeaderCapture and WithRequestID,
+// or if it hasn't received the request. Only the most recent 1,000 requests
+// are retained.
+func (s *Server) RequestHeaders(id string) (http.Header, bool) {
+	if s.headers == nil {
+		return nil, false
+	}
+	s.headers.mu.Lock()
+	defer s.headers.mu.Unlock()
+	h, ok := s.headers.byID.get(id)
+	return h.Clone(), ok
+}
+
+type requestHeaders struct {
+	mu   sync.Mutex
+	last http.Header
+	byID recentMap[http.Header]
+}
+
+func (h *requestHeaders) record(r *http.Request) {
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = header
+	if id, ok := RequestIDFromContext(r.Context()); ok {
+		h.byID.put(id, header)
+	}
+}
+
+// maxRecentRequests is the number of requests whose details are retained by
+// ID.
+const maxRecentRequests = 1000
+
+// recentMap holds values for the most recent maxRecentRequests IDs, evicting
+// the oldest. It's not safe for concurrent use.
+type recentMap[V any] struct {
+	byID map[string]V
+	ids  []string // oldest first
+}
+
+func (m *recentMap[V]) put(id string, v V) {
+	if m.byID == nil {
+		m.byID = make(map[string]V)
+	}
+	if _, ok := m.byID[id]; !ok {
+		if len(m.ids) == maxRecentRequests {
+			delete(m.byID, m.ids[0])
+			m.ids = m.ids[1:]
+		}
+		m.ids = append(m.ids, id)
+	}
+	m.byID[id] = v
+}
+
+func (m *recentMap[V]) get(id string) (V, bool) {
+	v, ok := m.byID[id]
+	return v, ok
+}
+
+type handleOrder struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (o *handleOrder) record(r *http.Request) {
+	id, ok := RequestIDFromContext(r.Context())
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.ids) == maxRecentRequests {
+		o.ids = o.ids[1:]
+	}
+	o.ids = append(o.ids, id)
+}
+
+// observers calls functions registered with OnRequest, in the order they were
+// registered.
+type observers struct {
+	mu   sync.RWMutex
+	next uint64
+	fns  []observer
+}
+
+type observer struct {
+	id uint64
+	f  func(*http.Request)
+}
+
+func (o *observers) add(f func(*http.Request)) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id := o.next
+	o.next++
+	o.fns = append(o.fns, observer{id: id, f: f})
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.fns = slices.DeleteFunc(o.fns, func(obs observer) bool { return obs.id == id })
+	}
+}
+
+func (o *observers) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Call observers without holding the lock, so that they can register
+		// and unregister observers.
+		o.mu.RLock()
+		fns := slices.Clone(o.fns)
+		o.mu.RUnlock()
+		for _, obs := range fns {
+			obs.f(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withObserver calls f with each request before passing it to next.
+func withObserver(f func(*http.Request), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f(r)
+		next.ServeHTTP(w, r)
+	})
+}
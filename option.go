@@ -2,15 +2,81 @@ package memhttp
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"net"
+	"net/http"
 	"time"
 )
 
 type config struct {
-	DisableTLS     bool
-	DisableHTTP2   bool
-	CleanupContext func() (context.Context, context.CancelFunc)
-	ErrorLog       *log.Logger
+	DisableTLS               bool
+	DisableHTTP2             bool
+	CleanupContext           func() (context.Context, context.CancelFunc)
+	ErrorLog                 *log.Logger
+	HARCapture               bool
+	HeaderCapture            bool
+	Clock                    Clock
+	ReadBufferSize           int
+	WriteBufferSize          int
+	RequestIDHeader          string
+	RequestTimeout           time.Duration
+	CipherSuites             []uint16
+	RequiredALPN             []string
+	RecordReplayDir          string
+	ForceChunked             bool
+	MaxRequestsPerConn       int
+	CertNotBefore            time.Time
+	CertNotAfter             time.Time
+	CertSANs                 []string
+	CA                       *CA
+	ClientCA                 *CA
+	PlaintextListener        bool
+	BodyLimits               map[string]int64
+	PathLatency              map[string]time.Duration
+	ResponseHeaders          http.Header
+	FlushStrategy            FlushStrategy
+	ClockSkew                time.Duration
+	AcceptBacklog            int
+	DialTimeout              time.Duration
+	ConnIdleTimeout          time.Duration
+	ConnBufferSize           int
+	Latency                  time.Duration
+	Bandwidth                int
+	ManualStart              bool
+	ConfigureServer          func(*http.Server)
+	BaseContext              func(net.Listener) context.Context
+	ConnState                func(net.Conn, http.ConnState)
+	TLSConfig                *tls.Config
+	Certificate              *tls.Certificate
+	H2C                      bool
+	StrictTLS                bool
+	MaxReadChunk             int
+	MaxIdleConns             int
+	MaxIdleConnsPerHost      int
+	MaxConnsPerHost          int
+	KeyType                  KeyType
+	ServeError               error
+	SkipHostnameVerification bool
+	HTTP2ConnWindow          int
+	HTTP2StreamWindow        int
+	ServerTiming             bool
+	ShutdownObserver         func(string)
+	Name                     string
+	StartupDelay             time.Duration
+	StartupBlock             bool
+}
+
+// http2Config returns the HTTP/2 configuration shared by the server and its
+// transports, or nil to use net/http's defaults.
+func (cfg *config) http2Config() *http.HTTP2Config {
+	if cfg.HTTP2ConnWindow == 0 && cfg.HTTP2StreamWindow == 0 {
+		return nil
+	}
+	return &http.HTTP2Config{
+		MaxReceiveBufferPerConnection: cfg.HTTP2ConnWindow,
+		MaxReceiveBufferPerStream:     cfg.HTTP2StreamWindow,
+	}
 }
 
 // An Option configures a Server.
@@ -36,6 +102,16 @@ func WithoutHTTP2() Option {
 	})
 }
 
+// WithH2C serves unencrypted HTTP/2 (often called h2c), as many gRPC and
+// Connect servers do in production. It implies WithoutTLS. The server also
+// accepts HTTP/1.1, but clients and transports returned by the server use
+// HTTP/2 with prior knowledge.
+func WithH2C() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.H2C = true
+	})
+}
+
 // WithOptions composes multiple Options into one.
 func WithOptions(opts ...Option) Option {
 	return optionFunc(func(cfg *config) {
@@ -61,3 +137,557 @@ func WithErrorLog(l *log.Logger) Option {
 		cfg.ErrorLog = l
 	})
 }
+
+// WithName names the server, which helps tell servers apart when several of
+// them log to the same place. Every line the server logs is prefixed with the
+// name in brackets, like "[billing] ". Name reports the server's name.
+func WithName(name string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.Name = name
+	})
+}
+
+// namedLogger returns a copy of l that prefixes each line with the server's
+// name. If l is nil, it copies the standard logger.
+func namedLogger(l *log.Logger, name string) *log.Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return log.New(l.Writer(), "["+name+"] "+l.Prefix(), l.Flags())
+}
+
+// WithHARCapture records every exchange the server handles, so that they can
+// later be written as an HTTP Archive with [Server.WriteHAR]. Bodies are
+// captured as the handler reads and writes them, so streaming isn't affected,
+// but only the first 64KiB of each request and response body is retained.
+func WithHARCapture() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.HARCapture = true
+	})
+}
+
+// WithHeaderCapture records the headers of the requests the server receives,
+// so that tests can inspect them with [Server.LastRequestHeaders] and
+// [Server.RequestHeaders]. Only the most recent 1,000 requests with IDs (see
+// WithRequestID) are retained.
+func WithHeaderCapture() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.HeaderCapture = true
+	})
+}
+
+// WithClock sets the Clock used for connection deadlines and other
+// timing-sensitive behavior. By default, servers use the system clock.
+func WithClock(c Clock) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.Clock = c
+	})
+}
+
+// WithTransportBufferSizes sets the read and write buffer sizes of transports
+// and clients returned by the server (see [http.Transport.ReadBufferSize]).
+// Larger buffers mean fewer, larger handoffs over the in-memory connection. By
+// default, both buffers are 32KiB. HTTP/2 connections manage their own
+// buffers and ignore these settings.
+func WithTransportBufferSizes(read, write int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ReadBufferSize = read
+		cfg.WriteBufferSize = write
+	})
+}
+
+// WithClientPool sets the connection pool sizes of transports and clients
+// returned by the server: see [http.Transport.MaxIdleConns],
+// [http.Transport.MaxIdleConnsPerHost], and [http.Transport.MaxConnsPerHost].
+// As with http.Transport, zero means the default (for MaxIdleConnsPerHost) or
+// no limit (for the others). It's useful for testing behavior that depends on
+// connection pooling.
+func WithClientPool(maxIdle, maxIdlePerHost, maxPerHost int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.MaxIdleConns = maxIdle
+		cfg.MaxIdleConnsPerHost = maxIdlePerHost
+		cfg.MaxConnsPerHost = maxPerHost
+	})
+}
+
+// WithRequestID assigns an ID to each request, so that tests can correlate
+// requests across clients, servers, and responses. If a request's header
+// doesn't already carry an ID, the server generates a random one. Either way,
+// the server echoes the ID in the response header and makes it available to
+// handlers via [RequestIDFromContext].
+func WithRequestID(header string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.RequestIDHeader = header
+	})
+}
+
+// WithRequestTimeout limits the time the handler may spend on each request by
+// wrapping it with [http.TimeoutHandler]. When the limit is exceeded, the
+// client receives a 503 Service Unavailable and the request's context is
+// cancelled. The limit uses the system clock, not the one set by WithClock.
+//
+// Like http.TimeoutHandler, the wrapper buffers each response until the
+// handler returns, so handlers can't flush partial responses and don't see an
+// [http.Flusher]. The server's other middleware (for example, HAR capture)
+// wraps the timeout handler and is unaffected.
+func WithRequestTimeout(d time.Duration) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.RequestTimeout = d
+	})
+}
+
+// WithRequiredALPN restricts the application protocols the server advertises
+// via ALPN to protos (by default, it advertises "h2", or "http/1.1" if it's
+// constructed WithoutHTTP2). Unlike a plain [tls.Config], the server then
+// rejects handshakes that don't negotiate one of protos: net/http clients
+// that offer only HTTP/1.1 fail the handshake rather than quietly falling back
+// to HTTP/1.1 without ALPN. It has no effect if the server is constructed
+// WithoutTLS.
+func WithRequiredALPN(protos ...string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.RequiredALPN = protos
+	})
+}
+
+// WithCipherSuites restricts the TLS cipher suites the server will negotiate
+// (see [tls.Config.CipherSuites]). It has no effect if the server is
+// constructed WithoutTLS.
+//
+// TLS 1.3 cipher suites aren't configurable, so the restriction only applies
+// to TLS 1.2 and earlier. Clients returned by the server negotiate TLS 1.3 by
+// default; to exercise the restriction, set the client transport's
+// TLSClientConfig.MaxVersion to [tls.VersionTLS12].
+//
+// Unless the server is constructed WithoutHTTP2, suites must include
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: net/http refuses to serve HTTP/2
+// without it. The error is reported by [Server.ServeError] and when the server
+// shuts down.
+func WithCipherSuites(suites ...uint16) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.CipherSuites = suites
+	})
+}
+
+// WithRecordReplay turns the server into a record-and-replay fixture. Requests
+// are identified by their method, URI, and body. The first time the server
+// sees a request, it calls the handler and records the response as a JSON
+// fixture in dir, creating dir if necessary. If a fixture already exists, the
+// server replays it without calling the handler. To re-record a response,
+// delete its fixture.
+//
+// Fixtures include the response status, headers, and body, but not trailers.
+// Request bodies are read fully before the handler is called, so this option
+// isn't suitable for streaming requests.
+func WithRecordReplay(dir string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.RecordReplayDir = dir
+	})
+}
+
+// WithForceChunked makes the server send responses without a Content-Length,
+// even if the handler sets one. HTTP/1.1 responses with bodies then use
+// chunked transfer encoding, and HTTP/2 responses are framed without a
+// declared length. It's useful for testing clients' handling of chunked
+// responses.
+func WithForceChunked() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ForceChunked = true
+	})
+}
+
+// WithMaxRequestsPerConn limits the number of requests the server handles on
+// each connection. The response to the last permitted request carries a
+// "Connection: close" header, so HTTP/1.1 servers close the connection and
+// HTTP/2 servers send GOAWAY. Clients must then open a new connection. It's
+// useful for testing clients' reconnection logic.
+func WithMaxRequestsPerConn(n int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.MaxRequestsPerConn = n
+	})
+}
+
+// WithCertificateValidity replaces the server's embedded TLS certificate with
+// a freshly-minted one, valid only from notBefore to notAfter. Clients
+// returned by the server check validity using the server's Clock, so
+// combining this option with WithClock lets tests simulate expired and
+// not-yet-valid certificates.
+func WithCertificateValidity(notBefore, notAfter time.Time) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.CertNotBefore = notBefore
+		cfg.CertNotAfter = notAfter
+	})
+}
+
+// WithGeneratedCert replaces the server's embedded TLS certificate, which only
+// covers example.com and the loopback addresses, with a freshly-minted one
+// covering the given DNS names and IP addresses. The certificate is issued by
+// an in-memory certificate authority, which clients returned by the server
+// trust.
+//
+// If the SANs don't include example.com, the server's clients verify its
+// certificate against the first SAN. To simulate requests to other names,
+// set the ServerName of the client transport's TLSClientConfig or use a
+// [Resolver].
+func WithGeneratedCert(sans ...string) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.CertSANs = sans
+	})
+}
+
+// WithCertificate makes the server present cert instead of its default
+// certificate. Clients and transports returned by the server trust cert's
+// leaf certificate directly, so it may be self-signed or issued by any CA. If
+// the leaf doesn't cover the server's hostname, clients verify it against its
+// first DNS name (or IP address) instead. WithCertificate takes precedence
+// over WithCA, WithGeneratedCert, WithCertificateValidity, and WithKeyType.
+// It has no effect if the server is constructed WithoutTLS.
+func WithCertificate(cert tls.Certificate) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.Certificate = &cert
+	})
+}
+
+// WithKeyType replaces the server's embedded TLS certificate, which has an
+// RSA2048 key, with a freshly-minted one using the given key type. It also
+// sets the key type of certificates minted for other options, like
+// WithGeneratedCert, which otherwise use ECDSAP256 keys. It's useful for
+// testing clients that only accept some signature algorithms.
+func WithKeyType(k KeyType) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.KeyType = k
+	})
+}
+
+// WithoutHostnameVerification makes transports and clients returned by the
+// server verify its certificate chain, but not its hostname: any certificate
+// issued by a trusted root is accepted, whatever names it covers. Unlike
+// setting InsecureSkipVerify, expired and untrusted certificates are still
+// rejected. It's useful for testing certificates whose SANs don't match the
+// requested host.
+func WithoutHostnameVerification() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.SkipHostnameVerification = true
+	})
+}
+
+// WithCA makes the server present a certificate issued by ca, which clients
+// returned by the server trust. By default, the certificate covers the same
+// names as the embedded certificate and is valid for as long as ca is; use
+// WithGeneratedCert and WithCertificateValidity to customize it.
+func WithCA(ca *CA) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.CA = ca
+	})
+}
+
+// WithTLSConfig customizes the server's TLS configuration. The server uses a
+// copy of cfg, filling in any of Certificates, NextProtos, CipherSuites, and
+// ClientCAs (with ClientAuth) that cfg leaves unset from its defaults and
+// other options. If cfg sets VerifyConnection, it runs after the server's own
+// checks. WithTLSConfig has no effect if the server is constructed
+// WithoutTLS.
+//
+// Clients and transports returned by the server still trust only the
+// server's default certificate (or the one issued by WithCA). If cfg supplies
+// its own certificates, configure the client transport's TLSClientConfig to
+// trust them.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return optionFunc(func(c *config) {
+		c.TLSConfig = cfg
+	})
+}
+
+// WithClientCA requires clients to present a certificate issued by ca, as in
+// mutual TLS. Handlers can inspect the client's certificate via the request's
+// TLS field. To construct a client that presents a certificate, use
+// [Server.ClientWithCertificate]. WithClientCA has no effect if the server is
+// constructed WithoutTLS.
+func WithClientCA(ca *CA) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ClientCA = ca
+	})
+}
+
+// WithPlaintextListener makes a TLS server also serve plaintext HTTP, using
+// the same handler, on a separate in-memory listener. Use [Server.PlaintextURL]
+// to address it; the server's clients send requests for port 80 to the
+// plaintext listener. It's useful for testing redirects from HTTP to HTTPS.
+// WithPlaintextListener has no effect if the server is constructed
+// WithoutTLS.
+//
+// Both listeners are served by the same [http.Server], so they share the
+// handler (and all the server's middleware) rather than using copies. State
+// the handler keeps in memory is visible over either scheme. As with any
+// http.Handler, the handler must be safe to call concurrently.
+func WithPlaintextListener() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.PlaintextListener = true
+	})
+}
+
+// WithBodyLimit limits the size of request bodies using
+// [http.MaxBytesReader]. Limits are keyed by URL path prefix, and each request
+// uses the limit with the longest matching prefix; use "/" to set a default.
+// Requests that don't match any prefix are unlimited. Once a handler reads
+// past the limit, reads fail with an [http.MaxBytesError]. Over HTTP/1.1, the
+// server also closes the connection after the response.
+func WithBodyLimit(limits map[string]int64) Option {
+	copied := make(map[string]int64, len(limits))
+	for prefix, n := range limits {
+		copied[prefix] = n
+	}
+	return optionFunc(func(cfg *config) {
+		cfg.BodyLimits = copied
+	})
+}
+
+// WithPathLatency delays requests before they reach the handler, simulating a
+// service with some slow endpoints. Latencies are keyed by URL path prefix,
+// and when several prefixes match a request, the longest one wins; use "/" to
+// set a default. Requests that don't match any prefix aren't delayed. If a
+// request is canceled while it's delayed, the handler isn't called. Delays
+// are measured with the server's Clock.
+func WithPathLatency(latencies map[string]time.Duration) Option {
+	copied := make(map[string]time.Duration, len(latencies))
+	for prefix, d := range latencies {
+		copied[prefix] = d
+	}
+	return optionFunc(func(cfg *config) {
+		cfg.PathLatency = copied
+	})
+}
+
+// WithResponseHeaders adds headers to every response. Handlers can override
+// them: if a handler sets a header before writing the response, its values
+// replace the defaults.
+func WithResponseHeaders(h http.Header) Option {
+	defaults := make(http.Header, len(h))
+	for key, values := range h {
+		defaults[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return optionFunc(func(cfg *config) {
+		cfg.ResponseHeaders = defaults
+	})
+}
+
+// WithFlushStrategy controls how the server batches response bodies before
+// sending them to the client. By default, the server uses net/http's
+// buffering.
+func WithFlushStrategy(s FlushStrategy) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.FlushStrategy = s
+	})
+}
+
+// WithServerTiming makes the server report how long each handler took in a
+// Server-Timing response header, like "handler;dur=12.345" (in milliseconds).
+// Since headers precede the body, the duration is measured from the start of
+// the handler until it first writes or flushes the response; handlers that
+// don't write anything report their total duration. Durations are measured
+// with the server's Clock.
+func WithServerTiming() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ServerTiming = true
+	})
+}
+
+// WithStartupDelay simulates a server that accepts connections before it's
+// ready to serve requests. For d after New returns (measured with the
+// server's Clock), requests get a 503 Service Unavailable response with a
+// Retry-After header. If block is true, requests instead wait until the delay
+// elapses and are then handled normally; requests that are canceled, or that
+// are still waiting when the server shuts down, get a 503.
+func WithStartupDelay(d time.Duration, block bool) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.StartupDelay = d
+		cfg.StartupBlock = block
+	})
+}
+
+// WithShutdownObserver registers a function that's called as Close and
+// Shutdown progress through each phase of shutdown: ShutdownStoppedAccepting,
+// ShutdownDraining, ShutdownClosingIdle, and ShutdownDone. Close reports only
+// the first and last phases, and Shutdown skips ShutdownDraining if no
+// requests are in flight. The function is called synchronously, so it must
+// not block.
+func WithShutdownObserver(observe func(phase string)) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ShutdownObserver = observe
+	})
+}
+
+// WithClockSkew offsets the Date header of every response by d, simulating a
+// server whose clock has drifted. Dates are computed using the server's
+// Clock. Handlers that set the Date header themselves are unaffected.
+func WithClockSkew(d time.Duration) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ClockSkew = d
+	})
+}
+
+// WithAcceptBacklog sets the number of dialed connections that may wait for
+// the server to accept them, like the backlog of a TCP listener. With the
+// default backlog of zero, each dial waits until the server accepts the
+// connection; with a larger backlog, up to n dials complete immediately even
+// if the server is busy or paused (see [Server.Pause]). When the server
+// closes, it closes any connections still in the backlog.
+//
+// The backlog is fixed when the server is constructed.
+func WithAcceptBacklog(n int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.AcceptBacklog = n
+	})
+}
+
+// WithDialTimeout bounds the time a dial waits for the server to accept the
+// connection, independent of the dial's context. Dials that time out fail
+// with an error wrapping [os.ErrDeadlineExceeded]. It's a safety net against
+// hangs when the server is paused, busy, or shutting down. The timeout uses
+// the server's Clock. By default, dials wait until their context ends.
+func WithDialTimeout(d time.Duration) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.DialTimeout = d
+	})
+}
+
+// WithBaseContext sets the function that provides the base context for all
+// the server's requests (see [http.Server.BaseContext]). Values in the base
+// context are visible to handlers, and canceling it cancels all in-flight
+// requests, with the base context's cause as their cause. The listener passed
+// to base is one of the server's in-memory listeners.
+func WithBaseContext(base func(net.Listener) context.Context) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.BaseContext = base
+	})
+}
+
+// WithConnState registers a function that's called whenever a connection to
+// the server changes state (see [http.Server.ConnState]). Since net/http
+// drives the transitions, the in-memory connections go through the same
+// states as TCP connections would.
+func WithConnState(hook func(net.Conn, http.ConnState)) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ConnState = hook
+	})
+}
+
+// WithHTTPServer calls configure with the server's underlying [http.Server]
+// before it starts serving, so tests can set fields that memhttp doesn't
+// expose as options (for example, MaxHeaderBytes or ReadHeaderTimeout).
+//
+// memhttp relies on the Handler, BaseContext, ConnContext, and ConnState
+// fields, so replacing them disables features like ShuttingDown and
+// ActiveRequests; wrap the existing values instead. The TLS listener has
+// already captured TLSConfig, so modify it in place rather than replacing it.
+func WithHTTPServer(configure func(*http.Server)) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ConfigureServer = configure
+	})
+}
+
+// WithConnectionBuffer gives each direction of the server's in-memory
+// connections a buffer of size bytes, like a socket buffer. By default,
+// connections are synchronous: each write blocks until the other end reads
+// it. With a buffer, writes return as soon as their data fits, which speeds
+// up tests and benchmarks that stream large bodies.
+func WithConnectionBuffer(size int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ConnBufferSize = size
+	})
+}
+
+// WithLatency simulates network delay: every write to one of the server's
+// in-memory connections, from either end, waits d before the data is
+// delivered. Since each request involves several writes (and TLS handshakes
+// several more), round trips take at least d and usually a small multiple of
+// it. Waits respect the connection's deadlines, so requests whose contexts
+// end mid-delay fail as they would over a slow network. Delays are measured
+// with the server's Clock.
+func WithLatency(d time.Duration) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.Latency = d
+	})
+}
+
+// WithBandwidth limits each direction of the server's in-memory connections
+// to bytesPerSecond, simulating a slow network or a slow client. Large writes
+// are paced rather than rejected: data arrives steadily, in chunks worth
+// about 20ms of bandwidth. Paced writes respect the connection's deadlines
+// and return promptly if it closes, so shutdown isn't delayed. Bandwidth is
+// measured with the server's Clock.
+func WithBandwidth(bytesPerSecond int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.Bandwidth = bytesPerSecond
+	})
+}
+
+// WithManualStart makes New return a server that doesn't serve requests until
+// Start is called. Until then, dials (and connections passed to ServeConn)
+// wait in the accept backlog, as if the server were paused. Closing or
+// shutting down an unstarted server is safe.
+func WithManualStart() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ManualStart = true
+	})
+}
+
+// WithConnIdleTimeout closes the in-memory connections underlying the server's
+// HTTP connections once no data has flowed over them for d, as a NAT or
+// firewall reaps idle sockets. Afterwards, reads and writes on both ends
+// fail. Unlike [http.Server.IdleTimeout], the timeout applies below HTTP, so
+// neither the client nor the server is warned. The timeout is measured with
+// the server's Clock.
+func WithConnIdleTimeout(d time.Duration) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ConnIdleTimeout = d
+	})
+}
+
+// WithStrictTLS makes failed TLS handshakes fatal. By default, net/http logs
+// handshake failures and carries on, so a misconfigured client or certificate
+// may only show up as an obscure log line. With WithStrictTLS, the server
+// records the first failure: [Server.ServeError] reports it as soon as the
+// failed connection closes, and Close, Shutdown, and Cleanup return it. It has
+// no effect if the server is constructed WithoutTLS.
+func WithStrictTLS() Option {
+	return optionFunc(func(cfg *config) {
+		cfg.StrictTLS = true
+	})
+}
+
+// WithChunkedDelivery makes every read from the server's in-memory
+// connections, on both the client and server sides, return at most maxChunk
+// bytes, no matter how much data is waiting. It simulates the fragmented
+// delivery of real networks, which forces code to handle short reads. It
+// doesn't affect the HTTP framing of responses; see WithForceChunked for
+// chunked transfer encoding.
+func WithChunkedDelivery(maxChunk int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.MaxReadChunk = maxChunk
+	})
+}
+
+// WithServeError makes the server fail as soon as it starts, as if
+// [http.Server.Serve] had returned err. The server never accepts any
+// connections. [Server.ServeError], Close, Shutdown, and Cleanup all report
+// err. It's useful for testing code that handles servers failing at runtime,
+// without contriving a real failure.
+func WithServeError(err error) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.ServeError = err
+	})
+}
+
+// WithHTTP2FlowControl sets the HTTP/2 flow-control windows for data received
+// by the server and by transports and clients returned by the server: see
+// [http.HTTP2Config.MaxReceiveBufferPerConnection] and
+// [http.HTTP2Config.MaxReceiveBufferPerStream]. Once a window is full, the
+// sender's writes block until the receiver reads. Small windows make it easy to
+// test how streaming code handles backpressure. Windows of zero (or invalid
+// sizes, like connection windows smaller than 64KiB) use net/http's defaults.
+func WithHTTP2FlowControl(connWindow, streamWindow int) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.HTTP2ConnWindow = connWindow
+		cfg.HTTP2StreamWindow = streamWindow
+	})
+}
@@ -0,0 +1,138 @@
+package memhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Resolver routes requests to in-memory servers by hostname, like a hosts
+// file. It lets a single client reach several servers using arbitrary names,
+// which is useful when testing service discovery or multi-service flows.
+//
+// The zero value is an empty Resolver, ready to use.
+type Resolver struct {
+	mu    sync.RWMutex
+	hosts map[string]*Server
+}
+
+// Register routes requests for host (without a port) to s, replacing any
+// previous registration for host. Requests for unregistered hosts fail
+// immediately with a [*net.DNSError] reporting that the host wasn't found, as
+// they would on a real network.
+func (r *Resolver) Register(host string, s *Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string]*Server)
+	}
+	r.hosts[host] = s
+}
+
+// Transport returns an [http.Transport] that dials registered servers over
+// in-memory pipes and disables automatic compression. Each server's TLS
+// certificate is trusted only for connections to that server, and HTTP/2 is
+// used if the server supports it.
+//
+// Callers may reconfigure the returned Transport without affecting other
+// transports or clients.
+func (r *Resolver) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:        r.dialContext,
+		DialTLSContext:     r.dialTLSContext,
+		DisableCompression: true,
+		ForceAttemptHTTP2:  true,
+	}
+}
+
+// Client returns an [http.Client] that uses the Resolver's Transport.
+//
+// Callers may reconfigure the returned client without affecting other clients.
+func (r *Resolver) Client() *http.Client {
+	return &http.Client{Transport: r.Transport()}
+}
+
+// lookup finds the server registered for addr. Like a real DNS lookup for a
+// nonexistent host, it fails immediately for unregistered hosts, returning a
+// *net.OpError wrapping a *net.DNSError with IsNotFound set.
+func (r *Resolver) lookup(network, addr string) (*Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	r.mu.RLock()
+	s, ok := r.hosts[host]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: &net.DNSError{
+				Err:        "no memhttp server registered",
+				Name:       host,
+				IsNotFound: true,
+			},
+		}
+	}
+	return s, nil
+}
+
+func (r *Resolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, err := r.lookup(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Plaintext requests go to the plaintext listener, if there is one.
+	lis := s.listener
+	if s.plaintext != nil {
+		lis = s.plaintext
+	}
+	return lis.DialContext(ctx, network, lis.Addr().String())
+}
+
+func (r *Resolver) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, err := r.lookup(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.certificate == nil {
+		return nil, fmt.Errorf("dial %s: memhttp server doesn't use TLS", addr)
+	}
+	conn, err := s.listener.DialContext(ctx, network, s.listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(s.certificate)
+	protos := []string{"h2", "http/1.1"}
+	if s.disableHTTP2 {
+		protos = []string{"http/1.1"}
+	}
+	// Verify the server's certificate against the requested host if it
+	// covers it, and against the names the server's own clients use if not.
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if s.leaf.VerifyHostname(host) != nil {
+		host = s.serverName
+		if host == "" {
+			host = s.listener.Addr().String()
+		}
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: host,
+		RootCAs:    pool,
+		NextProtos: protos,
+		Time:       s.clock.Now,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
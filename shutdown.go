@@ -0,0 +1,93 @@
+package memhttp
+
+// Shutdown phases, reported to the function registered with
+// WithShutdownObserver.
+const (
+	// ShutdownStoppedAccepting means the server has stopped accepting new
+	// connections.
+	ShutdownStoppedAccepting = "stopped accepting"
+	// ShutdownDraining means the server is waiting for in-flight requests to
+	// finish. It's only reported by Shutdown, and only if requests were in
+	// flight when shutdown began.
+	ShutdownDraining = "draining"
+	// ShutdownClosingIdle means no requests are in flight, and the server is
+	// closing its idle connections. It's only reported by Shutdown.
+	ShutdownClosingIdle = "closing idle"
+	// ShutdownDone means Close or Shutdown is about to return.
+	ShutdownDone = "done"
+)
+
+// phaseObserver reports the phases of one call to Close or Shutdown.
+type phaseObserver struct {
+	observe func(string)
+	stop    chan struct{}
+	done    chan struct{}
+	stopped bool // set by watch before done is closed
+	idle    bool // set by watch before done is closed
+}
+
+// observeShutdown starts reporting shutdown phases to s's observer, if it has
+// one. If graceful is false, it only reports ShutdownStoppedAccepting.
+func (s *Server) observeShutdown(graceful bool) *phaseObserver {
+	p := &phaseObserver{
+		observe: s.shutdownObserver,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if p.observe == nil {
+		close(p.done)
+		return p
+	}
+	draining := graceful && s.conns.inFlightCount() > 0
+	go p.watch(s, graceful, draining)
+	return p
+}
+
+func (p *phaseObserver) watch(s *Server, graceful, draining bool) {
+	defer close(p.done)
+	select {
+	case <-s.listener.closed:
+	case <-p.stop:
+		return
+	}
+	p.stopped = true
+	p.observe(ShutdownStoppedAccepting)
+	if !graceful {
+		return
+	}
+	if draining {
+		p.observe(ShutdownDraining)
+		for {
+			n, changed := s.conns.watchInFlight()
+			if n == 0 {
+				break
+			}
+			select {
+			case <-changed:
+			case <-p.stop:
+				return
+			}
+		}
+	}
+	p.idle = true
+	p.observe(ShutdownClosingIdle)
+}
+
+// finish reports the remaining phases once Close or Shutdown has done its
+// work. The server may return before its listener closes (for example, if
+// Serve hadn't started yet), so finish also reports any phases that watch
+// missed.
+func (p *phaseObserver) finish(ok bool) {
+	close(p.stop)
+	<-p.done
+	if p.observe == nil {
+		return
+	}
+	if !p.stopped {
+		p.observe(ShutdownStoppedAccepting)
+	}
+	if ok && !p.idle {
+		p.observe(ShutdownClosingIdle)
+	}
+	p.observe(ShutdownDone)
+}